@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// archAll is the architecture of packages without machine specific content.
+const archAll = "all"
+
+type arch struct {
+	Deb string
+	RPM string
+
+	// RPM lead architecture number, see rpmrc.in
+	RPMLead uint16
+}
+
+// architectures maps Go architecture names to package architectures.
+var architectures = map[string]arch{
+	"386":     {"i386", "i386", 1},
+	"amd64":   {"amd64", "x86_64", 1},
+	"arm":     {"armhf", "armv7hl", 12},
+	"arm64":   {"arm64", "aarch64", 19},
+	"ppc64le": {"ppc64el", "ppc64le", 16},
+	"riscv64": {"riscv64", "riscv64", 22},
+	"s390x":   {"s390x", "s390x", 15},
+	archAll:   {"all", "noarch", 0},
+}
+
+// parseArch returns the Go architecture name for name, which is either a Go,
+// Debian or RPM architecture name.
+func parseArch(name string) (string, error) {
+	if _, ok := architectures[name]; ok {
+		return name, nil
+	}
+	for goarch, a := range architectures {
+		if name == a.Deb || name == a.RPM {
+			return goarch, nil
+		}
+	}
+
+	var names = make([]string, 0, len(architectures))
+	for goarch := range architectures {
+		names = append(names, goarch)
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("unsupported architecture %q, expected one of %v", name, names)
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"io"
-	"os"
+	"time"
 )
 
 type Archive interface {
-	Add(string, os.FileMode, []byte)
+	Add(leaf)
+	AddScripts(Scripts)
+	SetCompression(string, int) error
+	SetSourceDate(time.Time)
 	Name() string
+	NameData() templateData
 	ParseMeta(PackageMeta) error
 	WriteTo(io.Writer) error
 }
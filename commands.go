@@ -0,0 +1,268 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var commands = map[string]func([]string) int{
+	"build":    buildCommand,
+	"list":     listCommand,
+	"validate": validateCommand,
+	"contents": contentsCommand,
+	"schema":   schemaCommand,
+}
+
+// commandFlags are the flags shared by all commands.
+type commandFlags struct {
+	*flag.FlagSet
+	config *string
+	arch   *string
+	output *string
+}
+
+func newCommandFlags(name, args string) commandFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s [flags] %s\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return commandFlags{
+		FlagSet: fs,
+		config:  fs.String("config", "", "Ship config (default "+strings.Join(configNames, ", ")+")"),
+		arch:    fs.String("arch", "", "Override the architecture of all packages"),
+		output:  fs.String("output", "", "Override the output directory of all packages"),
+	}
+}
+
+// parse parses flags and positional arguments, which may be interspersed.
+func (f commandFlags) parse(args []string) []string {
+	var names []string
+	for {
+		f.Parse(args)
+		if f.NArg() == 0 {
+			return names
+		}
+		names = append(names, f.Arg(0))
+		args = f.Args()[1:]
+	}
+}
+
+// packages loads the config and verifies the selected packages, or all
+// packages if none are selected. Verification errors are returned per package.
+func (f commandFlags) packages(selected []string) ([]string, map[string]*Package, map[string]error) {
+	if *f.config == "" {
+		*f.config = findConfig()
+	}
+	c := loadConfig(*f.config)
+
+	var names = selected
+	if len(names) == 0 {
+		for name := range c.Package {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var (
+		pkgs   = make(map[string]*Package)
+		failed = make(map[string]error)
+	)
+	for _, name := range names {
+		pkg, ok := c.Package[name]
+		if !ok {
+			failed[name] = fmt.Errorf("no package %q in %s", name, *f.config)
+			continue
+		}
+		if *f.arch != "" {
+			pkg.Architecture = *f.arch
+		}
+		if *f.output != "" {
+			pkg.OutputDir = *f.output
+		}
+		if err := pkg.Verify(name, c.Meta); err != nil {
+			failed[name] = err
+			continue
+		}
+		pkgs[name] = &pkg
+	}
+	return names, pkgs, failed
+}
+
+// report prints the errors per package, and returns the exit code.
+func report(verb string, names []string, failed map[string]error) int {
+	if len(failed) == 0 {
+		return 0
+	}
+	for _, name := range names {
+		if err, ok := failed[name]; ok {
+			fmt.Printf("error %s %s:\n", verb, name)
+			for _, line := range strings.Split(strings.TrimSpace(err.Error()), "\n") {
+				fmt.Println("  error:", line)
+			}
+		}
+	}
+	return 1
+}
+
+func buildCommand(args []string) int {
+	var (
+		f        = newCommandFlags("build", "[package...]")
+		parallel = f.Int("j", 1, "Number of packages and formats to build concurrently")
+		formats  = f.String("format", "", "Comma separated list of formats to build")
+	)
+	names, pkgs, failed := f.packages(f.parse(args))
+
+	var only map[string]bool
+	if *formats != "" {
+		only = make(map[string]bool)
+		for _, format := range strings.Split(*formats, ",") {
+			if !supportedFormats[format] {
+				fmt.Printf("error: unsupported format %q\n", format)
+				return 2
+			}
+			only[format] = true
+		}
+	}
+
+	var (
+		j  = newJobs(*parallel)
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, name := range names {
+		pkg, ok := pkgs[name]
+		if !ok {
+			continue
+		}
+		if only != nil {
+			var selected []string
+			for _, format := range pkg.Formats {
+				if only[format] {
+					selected = append(selected, format)
+				}
+			}
+			if len(selected) == 0 {
+				fmt.Println("skipping", name, "no selected formats")
+				continue
+			}
+			pkg.Formats = selected
+		}
+
+		fmt.Println("building", name, pkg.Version)
+		wg.Add(1)
+		go func(name string, pkg *Package) {
+			defer wg.Done()
+			if err := pkg.Build(j); err != nil {
+				mu.Lock()
+				failed[name] = err
+				mu.Unlock()
+			}
+		}(name, pkg)
+	}
+	wg.Wait()
+
+	return report("building", names, failed)
+}
+
+func listCommand(args []string) int {
+	var f = newCommandFlags("list", "[package...]")
+	names, pkgs, failed := f.packages(f.parse(args))
+
+	for _, name := range names {
+		pkg, ok := pkgs[name]
+		if !ok {
+			continue
+		}
+		fmt.Println(name, pkg.Version)
+		for _, platform := range pkg.platforms() {
+			for _, format := range pkg.Formats {
+				out, err := pkg.archive(format, platform)
+				if err != nil {
+					failed[name] = err
+					break
+				}
+				file, err := pkg.output(format, out, platform)
+				if err != nil {
+					failed[name] = err
+					break
+				}
+				fmt.Println("  " + file)
+			}
+		}
+	}
+
+	return report("listing", names, failed)
+}
+
+func validateCommand(args []string) int {
+	var f = newCommandFlags("validate", "[package...]")
+	names, pkgs, failed := f.packages(f.parse(args))
+
+	for _, name := range names {
+		if _, ok := pkgs[name]; ok {
+			fmt.Println("ok", name)
+		}
+	}
+
+	return report("validating", names, failed)
+}
+
+func contentsCommand(args []string) int {
+	var (
+		f        = newCommandFlags("contents", "package...")
+		generate = f.Bool("generate", false, "Run the generate commands before collecting files")
+		selected = f.parse(args)
+	)
+	if len(selected) == 0 {
+		f.Usage()
+		return 2
+	}
+	names, pkgs, failed := f.packages(selected)
+
+	for _, name := range names {
+		if pkg, ok := pkgs[name]; ok {
+			if err := printContents(pkg, *generate); err != nil {
+				failed[name] = err
+			}
+		}
+	}
+
+	return report("listing", names, failed)
+}
+
+// printContents prints the tree of the package for each platform.
+func printContents(pkg *Package, generate bool) error {
+	cleanup, err := pkg.clone()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	for _, platform := range pkg.platforms() {
+		fmt.Println(pkg.Name, pkg.Version, platform)
+		if generate {
+			if err := pkg.generate(platform); err != nil {
+				return err
+			}
+		}
+		t, err := pkg.collect(platform)
+		if err != nil {
+			return err
+		}
+		for _, l := range t.sorted() {
+			var line = fmt.Sprintf("  %s %s:%s %s", l.mode.String(), l.owner, l.group, l.name)
+			if l.link != "" {
+				line += " -> " + l.link
+			} else if l.src != "" {
+				line += " " + l.src
+			}
+			fmt.Println(line)
+		}
+	}
+	return nil
+}
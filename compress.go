@@ -0,0 +1,117 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const defaultCompression = "gzip"
+
+type compression struct {
+	// Ext is the file name extension of compressed deb members.
+	Ext string
+
+	// RPM is the RPM payload compressor and the rpmlib feature it requires.
+	RPM       string
+	RPMLib    string
+	MaxLevel  int
+	Level     int
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+var compressions = map[string]compression{
+	"none": {
+		Ext: "",
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopCloser{w}, nil
+		},
+	},
+	"gzip": {
+		Ext:      ".gz",
+		RPM:      "gzip",
+		MaxLevel: gzip.BestCompression,
+		Level:    gzip.BestCompression,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+	},
+	"bzip2": {
+		Ext:      ".bz2",
+		RPM:      "bzip2",
+		RPMLib:   "rpmlib(PayloadIsBzip2) <= 3.0.5-1",
+		MaxLevel: bzip2.BestCompression,
+		Level:    bzip2.BestCompression,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+		},
+	},
+	"xz": {
+		Ext:      ".xz",
+		RPM:      "xz",
+		RPMLib:   "rpmlib(PayloadIsXz) <= 5.2-1",
+		MaxLevel: 9,
+		Level:    6,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			// Dictionary sizes of the xz(1) presets.
+			var dict = []int{18, 20, 21, 22, 22, 23, 23, 24, 25, 26}
+			return xz.WriterConfig{DictCap: 1 << uint(dict[level])}.NewWriter(w)
+		},
+	},
+	"zstd": {
+		Ext:      ".zst",
+		RPM:      "zstd",
+		RPMLib:   "rpmlib(PayloadIsZstd) <= 5.4.18-1",
+		MaxLevel: 22,
+		Level:    3,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zstd.NewWriter(w,
+				zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+				zstd.WithEncoderConcurrency(1))
+		},
+	},
+}
+
+// parseCompression validates the compression name and level. A level of zero
+// selects the default level of the compressor.
+func parseCompression(name string, level int) (string, int, error) {
+	if name == "" {
+		name = defaultCompression
+	}
+	c, ok := compressions[name]
+	if !ok {
+		var names = make([]string, 0, len(compressions))
+		for name := range compressions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", 0, fmt.Errorf("unsupported compression %q, expected one of %v", name, names)
+	}
+	if level == 0 {
+		level = c.Level
+	}
+	if level < 0 || level > c.MaxLevel {
+		return "", 0, fmt.Errorf("invalid %s compression level %d", name, level)
+	}
+	return name, level, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// newCompressor returns a writer compressing to w.
+func newCompressor(w io.Writer, name string, level int) (io.WriteCloser, error) {
+	c, ok := compressions[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression %q", name)
+	}
+	return c.newWriter(w, level)
+}
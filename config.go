@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configNames are tried in order if no config is given.
+var configNames = []string{"ship.json", "ship.yaml", "ship.yml", "ship.toml"}
+
+// findConfig returns the first config in the working directory.
+func findConfig() string {
+	for _, name := range configNames {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return configNames[0]
+}
+
+// positionError is an error at a line and column of the config, the column is
+// zero if unknown.
+type positionError struct {
+	line, col int
+	err       error
+}
+
+func (e *positionError) Error() string { return e.err.Error() }
+
+// decodeConfig parses a JSON, YAML or TOML config, selected by the extension
+// of name. YAML and TOML are converted to JSON, so all formats decode to the
+// same structures. All problems found are returned.
+func decodeConfig(name string, b []byte, c *Config) []error {
+	var (
+		j        = b
+		position func(string, int64) (int, int, bool)
+		err      error
+	)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		var w *yamlJSON
+		if w, err = yamlToJSON(b); err != nil {
+			return []error{err}
+		}
+		j = w.buf.Bytes()
+		position = func(_ string, offset int64) (int, int, bool) {
+			return w.position(offset)
+		}
+	case ".toml":
+		if j, err = tomlToJSON(b); err != nil {
+			return []error{err}
+		}
+		// The TOML decoder doesn't keep positions, keys are found by path.
+		position = tomlKeyPositions(b).position
+	default:
+		position = func(_ string, offset int64) (int, int, bool) {
+			line, col := offsetPosition(string(b), offset)
+			return line, col, line > 0
+		}
+	}
+
+	if errs := checkConfig(j, position); len(errs) > 0 {
+		return errs
+	}
+	if err = json.Unmarshal(j, c); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+var yamlLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+func yamlToJSON(b []byte) (*yamlJSON, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, &positionError{line: line, err: errors.New(m[2])}
+		}
+		return nil, err
+	}
+
+	var w = new(yamlJSON)
+	if err := w.node(&doc); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// yamlJSON converts YAML to JSON, recording the position of each key and
+// value.
+type yamlJSON struct {
+	buf       bytes.Buffer
+	offsets   []int64
+	positions []*yaml.Node
+}
+
+// position returns the line and column of the last key or value starting
+// before offset in the JSON.
+func (w *yamlJSON) position(offset int64) (int, int, bool) {
+	i := sort.Search(len(w.offsets), func(i int) bool { return w.offsets[i] >= offset })
+	if i == 0 {
+		return 0, 0, false
+	}
+	return w.positions[i-1].Line, w.positions[i-1].Column, true
+}
+
+func (w *yamlJSON) mark(n *yaml.Node) {
+	w.offsets = append(w.offsets, int64(w.buf.Len()))
+	w.positions = append(w.positions, n)
+}
+
+func (w *yamlJSON) node(n *yaml.Node) error {
+	w.mark(n)
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			w.buf.WriteString("null")
+			return nil
+		}
+		return w.node(n.Content[0])
+
+	case yaml.AliasNode:
+		return w.node(n.Alias)
+
+	case yaml.SequenceNode:
+		w.buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			if err := w.node(item); err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte(']')
+		return nil
+
+	case yaml.MappingNode:
+		w.buf.WriteByte('{')
+		for i, pair := range yamlPairs(n) {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(pair[0].Value)
+			w.mark(pair[0])
+			w.buf.Write(key)
+			w.buf.WriteByte(':')
+			if err := w.node(pair[1]); err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte('}')
+		return nil
+
+	case yaml.ScalarNode:
+		var v interface{}
+		if err := n.Decode(&v); err != nil {
+			return &positionError{line: n.Line, col: n.Column, err: err}
+		}
+		if _, ok := v.(time.Time); ok {
+			v = n.Value
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return &positionError{line: n.Line, col: n.Column, err: err}
+		}
+		w.buf.Write(b)
+		return nil
+
+	default:
+		return &positionError{line: n.Line, col: n.Column, err: fmt.Errorf("unsupported YAML node %q", n.Tag)}
+	}
+}
+
+// yamlPairs returns the key and value nodes of a mapping, with merge keys (<<)
+// resolved. Keys of the mapping itself take precedence over merged keys.
+func yamlPairs(n *yaml.Node) [][2]*yaml.Node {
+	var (
+		pairs  [][2]*yaml.Node
+		merged [][2]*yaml.Node
+		seen   = make(map[string]bool)
+	)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Tag == "!!merge" {
+			if value.Kind == yaml.AliasNode {
+				value = value.Alias
+			}
+			var sources = []*yaml.Node{value}
+			if value.Kind == yaml.SequenceNode {
+				sources = value.Content
+			}
+			for _, source := range sources {
+				if source.Kind == yaml.AliasNode {
+					source = source.Alias
+				}
+				merged = append(merged, yamlPairs(source)...)
+			}
+			continue
+		}
+		seen[key.Value] = true
+		pairs = append(pairs, [2]*yaml.Node{key, value})
+	}
+	for _, pair := range merged {
+		if !seen[pair[0].Value] {
+			seen[pair[0].Value] = true
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+func tomlToJSON(b []byte) ([]byte, error) {
+	var v map[string]interface{}
+	if _, err := toml.Decode(string(b), &v); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, &positionError{line: parseErr.Position.Line, col: parseErr.Position.Col, err: errors.New(parseErr.Message)}
+		}
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// tomlPositions maps key paths, like package.ship.manifest[0].src, to the line
+// and column of the key or table header in a TOML config.
+type tomlPositions map[string][2]int
+
+// position returns the position of path, or of the closest parent found, as
+// keys in inline tables and arrays are not recorded.
+func (p tomlPositions) position(path string, _ int64) (int, int, bool) {
+	for path != "" {
+		if pos, ok := p[path]; ok {
+			return pos[0], pos[1], true
+		}
+		if strings.HasSuffix(path, "]") {
+			path = path[:strings.LastIndex(path, "[")]
+		} else if i := strings.LastIndex(path, "."); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+	return 0, 0, false
+}
+
+// tomlKeyPositions scans a valid TOML config for the positions of its keys.
+func tomlKeyPositions(b []byte) tomlPositions {
+	var (
+		positions = make(tomlPositions)
+		arrays    = make(map[string]int)
+		table     string
+		s         tomlScanner
+	)
+	// path returns the path of a table, with the index of arrays of tables.
+	path := func(keys []string) string {
+		var p string
+		for _, key := range keys {
+			if p != "" {
+				p += "."
+			}
+			p += key
+			if n, ok := arrays[p]; ok {
+				p += fmt.Sprintf("[%d]", n)
+			}
+		}
+		return p
+	}
+	record := func(p string, line, col int) {
+		if _, ok := positions[p]; !ok {
+			positions[p] = [2]int{line, col}
+		}
+	}
+
+	for i, line := range strings.Split(string(b), "\n") {
+		if s.depth > 0 || s.quote != "" {
+			s.scan(line)
+			continue
+		}
+		var (
+			rest = strings.TrimLeft(line, " \t")
+			col  = len(line) - len(rest) + 1
+		)
+		switch {
+		case rest == "" || rest[0] == '#':
+		case strings.HasPrefix(rest, "[["):
+			keys, _ := tomlKeys(rest[2:])
+			if len(keys) == 0 {
+				continue
+			}
+			var p = path(keys[:len(keys)-1])
+			if p != "" {
+				p += "."
+			}
+			p += keys[len(keys)-1]
+			if n, ok := arrays[p]; ok {
+				arrays[p] = n + 1
+			} else {
+				arrays[p] = 0
+			}
+			table = fmt.Sprintf("%s[%d]", p, arrays[p])
+			record(table, i+1, col)
+		case rest[0] == '[':
+			keys, _ := tomlKeys(rest[1:])
+			table = path(keys)
+			record(table, i+1, col)
+		default:
+			keys, value := tomlKeys(rest)
+			var p = strings.Join(keys, ".")
+			if table != "" {
+				p = table + "." + p
+			}
+			record(p, i+1, col)
+			s.scan(strings.TrimPrefix(strings.TrimLeft(value, " \t"), "="))
+		}
+	}
+	return positions
+}
+
+// tomlKeys parses a dotted key, and returns its parts and the rest of s.
+func tomlKeys(s string) ([]string, string) {
+	var keys []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		var key string
+		switch {
+		case strings.HasPrefix(s, `"`):
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return keys, ""
+			}
+			key, _ = strconv.Unquote(s[:end+1])
+			s = s[end+1:]
+		case strings.HasPrefix(s, "'"):
+			end := strings.IndexByte(s[1:], '\'')
+			if end < 0 {
+				return keys, ""
+			}
+			key, s = s[1:end+1], s[end+2:]
+		default:
+			end := strings.IndexFunc(s, func(r rune) bool {
+				return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+			})
+			if end < 0 {
+				end = len(s)
+			}
+			key, s = s[:end], s[end:]
+		}
+		keys = append(keys, key)
+		if s = strings.TrimLeft(s, " \t"); !strings.HasPrefix(s, ".") {
+			return keys, s
+		}
+		s = s[1:]
+	}
+}
+
+// tomlScanner follows the nesting of values and multi-line strings over
+// lines, keys are only read outside of values.
+type tomlScanner struct {
+	depth int
+	quote string
+}
+
+func (s *tomlScanner) scan(line string) {
+	for i := 0; i < len(line); i++ {
+		if s.quote != "" {
+			if line[i] == '\\' && s.quote[0] == '"' {
+				i++
+			} else if strings.HasPrefix(line[i:], s.quote) {
+				i += len(s.quote) - 1
+				s.quote = ""
+			}
+			continue
+		}
+		switch c := line[i]; c {
+		case '#':
+			return
+		case '"', '\'':
+			s.quote = string(c)
+			if strings.HasPrefix(line[i:], strings.Repeat(string(c), 3)) {
+				s.quote = strings.Repeat(string(c), 3)
+				i += 2
+			}
+		case '[', '{':
+			s.depth++
+		case ']', '}':
+			s.depth--
+		}
+	}
+	// Single line strings end with the line.
+	if len(s.quote) == 1 {
+		s.quote = ""
+	}
+}
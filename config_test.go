@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestTOMLKeyPositions(t *testing.T) {
+	var positions = tomlKeyPositions([]byte(`# ship
+[package.ship]
+version = "1.0"
+formats = [
+  "deb",
+]
+description = """
+bogus = 1
+"""
+  epoch = 1
+
+[package.ship.meta]
+summary = "x"
+
+[[package.ship.manifest]]
+src = "a"
+
+[[package.ship.manifest]]
+'src' = "b"
+`))
+
+	var tests = []struct {
+		path      string
+		line, col int
+	}{
+		{"package.ship", 2, 1},
+		{"package.ship.version", 3, 1},
+		{"package.ship.formats[0]", 4, 1},
+		{"package.ship.description", 7, 1},
+		{"package.ship.bogus", 2, 1},
+		{"package.ship.epoch", 10, 3},
+		{"package.ship.meta.summary", 13, 1},
+		{"package.ship.manifest[0].src", 16, 1},
+		{"package.ship.manifest[1].src", 19, 1},
+		{"package.ship.manifest[1].dst", 18, 1},
+	}
+	for _, test := range tests {
+		line, col, ok := positions.position(test.path, 0)
+		if !ok || line != test.line || col != test.col {
+			t.Errorf("%s: got %d:%d, want %d:%d", test.path, line, col, test.line, test.col)
+		}
+	}
+	if _, _, ok := positions.position("meta", 0); ok {
+		t.Error("meta: unexpected position")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	cpioNewcMagic = "070701"
+	cpioTrailer   = "TRAILER!!!"
+)
+
+// Unix file type bits, as used in cpio and RPM file modes.
+const (
+	modeIFMT  = 0170000
+	modeIFDIR = 0040000
+	modeIFREG = 0100000
+	modeIFLNK = 0120000
+)
+
+type cpioHeader struct {
+	Inode   int
+	Mode    uint32
+	UID     int
+	GID     int
+	Links   int
+	ModTime time.Time
+	Size    int64
+	Name    string
+}
+
+// cpioWriter writes archives in the SVR4 "newc" format, which is what RPM
+// expects as payload.
+type cpioWriter struct {
+	w io.Writer
+	n int64
+}
+
+func newCpioWriter(w io.Writer) *cpioWriter {
+	return &cpioWriter{w: w}
+}
+
+func (c *cpioWriter) write(b []byte) error {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return err
+}
+
+func (c *cpioWriter) pad() error {
+	if r := c.n % 4; r != 0 {
+		return c.write(make([]byte, 4-r))
+	}
+	return nil
+}
+
+func (c *cpioWriter) WriteHeader(h *cpioHeader) error {
+	var mtime int64
+	if !h.ModTime.IsZero() {
+		mtime = h.ModTime.Unix()
+	}
+	header := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cpioNewcMagic,
+		h.Inode,
+		h.Mode,
+		h.UID,
+		h.GID,
+		h.Links,
+		mtime,
+		h.Size,
+		0, 0, // device major, minor
+		0, 0, // rdevice major, minor
+		len(h.Name)+1,
+		0) // checksum
+	if err := c.write([]byte(header)); err != nil {
+		return err
+	}
+	if err := c.write(append([]byte(h.Name), 0)); err != nil {
+		return err
+	}
+	return c.pad()
+}
+
+func (c *cpioWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Flush pads the data of the current entry.
+func (c *cpioWriter) Flush() error {
+	return c.pad()
+}
+
+// Close writes the trailer entry; it does not close the underlying writer.
+func (c *cpioWriter) Close() error {
+	if err := c.WriteHeader(&cpioHeader{Links: 1, Name: cpioTrailer}); err != nil {
+		return err
+	}
+	return c.pad()
+}
+
+// Len returns the number of bytes written so far.
+func (c *cpioWriter) Len() int64 {
+	return c.n
+}
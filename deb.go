@@ -3,15 +3,13 @@ package main
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"crypto/md5"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
-	"sort"
 	"strings"
 	"time"
 
@@ -24,36 +22,39 @@ var (
 	defaultDebPriority = "optional"
 )
 
-var control = `Package: %s
-Version: %s
-Architecture: %s
-Maintainer: %s
-Installed-Size: %d
-Conflicts: %s
-Depends: %s
-Section: %s
-Priority: %s
-Homepage: %s
-Description: %s
-%s
-`
-
 type Deb struct {
-	Package         string
-	Version         string
-	Section         string
-	Priority        string
-	Architecture    string
-	Conflicts       []string
-	Depends         []string
-	Homepage        string
-	Maintainer      string
-	Description     string
-	LongDescription string
-	tree            tree
+	Package          string
+	Epoch            int
+	Version          string
+	Revision         string
+	Section          string
+	Priority         string
+	Architecture     string
+	PreDepends       []string
+	Depends          []string
+	Recommends       []string
+	Suggests         []string
+	Enhances         []string
+	Breaks           []string
+	Conflicts        []string
+	Replaces         []string
+	Provides         []string
+	Homepage         string
+	Maintainer       string
+	Description      string
+	LongDescription  string
+	Scripts          map[string]string
+	Compression      string
+	CompressionLevel int
+	tree             tree
+	sourceDate       time.Time
 }
 
-func NewDeb(name, version string) *Deb {
+func NewDeb(name, version, goarch string) (*Deb, error) {
+	a, ok := architectures[goarch]
+	if !ok {
+		return nil, fmt.Errorf("deb: unsupported architecture %q", goarch)
+	}
 	d := &Deb{
 		Package:      name,
 		Version:      version,
@@ -61,25 +62,64 @@ func NewDeb(name, version string) *Deb {
 		Depends:      make([]string, 0),
 		Section:      defaultDebSection,
 		Priority:     defaultDebPriority,
-		Architecture: runtime.GOARCH,
+		Architecture: a.Deb,
+		Compression:  defaultCompression,
 		tree:         make(tree),
 	}
-	if d.Architecture == "386" {
-		d.Architecture = "i386"
+	d.Compression, d.CompressionLevel, _ = parseCompression(d.Compression, 0)
+	return d, nil
+}
+
+func (d *Deb) Add(l leaf) {
+	d.tree[l.name] = l
+}
+
+func (d *Deb) AddScripts(s Scripts) {
+	d.Scripts = s.deb()
+}
+
+// SetCompression selects the compression of the control and data members.
+func (d *Deb) SetCompression(name string, level int) error {
+	var err error
+	d.Compression, d.CompressionLevel, err = parseCompression(name, level)
+	return err
+}
+
+// member returns the ar member name and compression of a tarball. dpkg does
+// not support bzip2 for the control member, it falls back to gzip.
+func (d *Deb) member(name string) (string, string, int) {
+	compression, level := d.Compression, d.CompressionLevel
+	if name == "control" && compression == "bzip2" {
+		compression, level, _ = parseCompression(defaultCompression, 0)
 	}
-	return d
+	return name + ".tar" + compressions[compression].Ext, compression, level
 }
 
-func (d *Deb) Add(name string, mode os.FileMode, data []byte) {
-	d.tree[name] = leaf{name: name, mode: mode, data: data}
+// SetSourceDate makes the build reproducible, using t for all timestamps.
+func (d *Deb) SetSourceDate(t time.Time) {
+	d.sourceDate = t
 }
 
 func (d *Deb) Name() string {
-	return fmt.Sprintf("%s_%s_%s.deb", d.Package, d.Version, d.Architecture)
+	// The epoch is not part of the file name.
+	return fmt.Sprintf("%s_%s_%s.deb", d.Package, debVersion(0, d.Version, d.Revision), d.Architecture)
+}
+
+func (d *Deb) NameData() templateData {
+	return templateData{Name: d.Package, Version: d.Version, Release: d.Revision, Arch: d.Architecture}
 }
 
 func (d *Deb) ParseMeta(meta PackageMeta) error {
 	d.Maintainer = meta.Email
+	d.PreDepends = meta.DebPreDepends
+	d.Depends = meta.DebRequires
+	d.Recommends = meta.DebRecommends
+	d.Suggests = meta.DebSuggests
+	d.Enhances = meta.DebEnhances
+	d.Breaks = meta.DebBreaks
+	d.Conflicts = meta.DebConflict
+	d.Replaces = meta.DebReplaces
+	d.Provides = meta.DebProvides
 	d.Homepage = meta.Homepage
 	d.Description = meta.Summary
 	d.LongDescription = meta.Description
@@ -88,33 +128,74 @@ func (d *Deb) ParseMeta(meta PackageMeta) error {
 
 func (d *Deb) control(size int64) string {
 	var (
+		buf  = new(bytes.Buffer)
 		long = d.LongDescription
 	)
+
+	// Empty fields are omitted, dpkg warns about blank relationship fields.
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(buf, "%s: %s\n", name, value)
+		}
+	}
+	relation := func(name string, value []string) {
+		field(name, strings.Join(value, ", "))
+	}
+
+	field("Package", d.Package)
+	field("Version", debVersion(d.Epoch, d.Version, d.Revision))
+	field("Architecture", d.Architecture)
+	field("Maintainer", d.Maintainer)
+	field("Installed-Size", fmt.Sprintf("%d", size))
+	relation("Pre-Depends", d.PreDepends)
+	relation("Depends", d.Depends)
+	relation("Recommends", d.Recommends)
+	relation("Suggests", d.Suggests)
+	relation("Enhances", d.Enhances)
+	relation("Breaks", d.Breaks)
+	relation("Conflicts", d.Conflicts)
+	relation("Replaces", d.Replaces)
+	relation("Provides", d.Provides)
+	field("Section", d.Section)
+	field("Priority", d.Priority)
+	field("Homepage", d.Homepage)
+	fmt.Fprintf(buf, "Description: %s\n", d.Description)
 	if long != "" {
-		long = text.Indent(text.Wrap(long, 76), "  ")
-	}
-	return fmt.Sprintf(control,
-		d.Package,
-		d.Version,
-		d.Architecture,
-		d.Maintainer,
-		size,
-		strings.Join(d.Conflicts, ", "),
-		strings.Join(d.Depends, ", "),
-		d.Section,
-		d.Priority,
-		d.Homepage,
-		d.Description,
-		long)
+		buf.WriteString(text.Indent(text.Wrap(long, 76), "  "))
+		buf.WriteString("\n")
+	}
+	return buf.String()
 }
 
 func (d *Deb) WriteTo(out io.Writer) error {
 	var (
-		now = time.Now()
-		deb = ar.NewWriter(out)
+		now  = time.Now()
+		deb  = ar.NewWriter(out)
+		size int64
 	)
+	if !d.sourceDate.IsZero() {
+		now = d.sourceDate
+	}
+
+	var (
+		dataName, _, _    = d.member("data")
+		controlName, _, _ = d.member("control")
+	)
+
+	// The data member is spooled to a temporary file, as the ar header needs
+	// its size up front.
+	data, err := ioutil.TempFile("", "ship-data-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	for _, leaf := range d.tree {
+		size += leaf.size()
+	}
 
-	dataTarball, md5sums, size, err := d.createDataTarball(now)
+	md5sums, err := d.createDataTarball(now, data)
 	if err != nil {
 		return err
 	}
@@ -129,108 +210,129 @@ func (d *Deb) WriteTo(out io.Writer) error {
 	if err := addArFile(now, deb, "debian-binary", []byte("2.0\n")); err != nil {
 		return fmt.Errorf("can't pack debian-binary: %v", err)
 	}
-	if err := addArFile(now, deb, "control.tar.gz", controlTarball); err != nil {
-		return fmt.Errorf("can't add control.tar.gz to deb: %v", err)
+	if err := addArFile(now, deb, controlName, controlTarball); err != nil {
+		return fmt.Errorf("can't add %s to deb: %v", controlName, err)
 	}
-	if err := addArFile(now, deb, "data.tar.gz", dataTarball); err != nil {
-		return fmt.Errorf("can't add data.tar.gz to deb: %v", err)
+	if err := addArStream(now, deb, out, dataName, data); err != nil {
+		return fmt.Errorf("can't add %s to deb: %v", dataName, err)
 	}
 
 	return nil
 }
 
-func (d *Deb) createDataTarball(now time.Time) ([]byte, []byte, int64, error) {
+// createDataTarball writes the data member to w, and returns the md5sums of
+// the files.
+func (d *Deb) createDataTarball(now time.Time, w io.Writer) ([]byte, error) {
 	var (
-		size   int64
-		buf    = new(bytes.Buffer)
-		zip    = gzip.NewWriter(buf)
-		out    = tar.NewWriter(zip)
 		md5buf = new(bytes.Buffer)
 		digest = md5.New()
 		dirs   = make(map[string]bool)
 	)
 
-	leafs := leafs{}
-	for _, leaf := range d.tree {
-		leafs = append(leafs, leaf)
+	_, compression, level := d.member("data")
+	zip, err := newCompressor(w, compression, level)
+	if err != nil {
+		return nil, err
 	}
-	sort.Sort(leafs)
-	for _, leaf := range leafs {
-		md5buf.WriteString(fmt.Sprintf("%x  %s\n", leaf.Checksum(digest), leaf.name))
+	out := tar.NewWriter(zip)
+
+	for _, leaf := range d.tree.sorted() {
 		if err := addTarDir(now, out, path.Dir(leaf.name), dirs); err != nil {
-			return nil, nil, 0, fmt.Errorf("can't write header of %s to data.tar.gz: %v", path.Dir(leaf.name), err)
+			return nil, fmt.Errorf("can't write header of %s to data.tar: %v", path.Dir(leaf.name), err)
 		}
 		header := tar.Header{
 			Name:     leaf.name,
-			Mode:     0644,
-			ModTime:  now,
-			Size:     int64(len(leaf.data)),
+			Mode:     int64(unixMode(leaf.mode) &^ modeIFMT),
+			Uid:      leaf.uid,
+			Gid:      leaf.gid,
+			Uname:    leaf.owner,
+			Gname:    leaf.group,
+			ModTime:  leaf.modTime(now),
 			Typeflag: tar.TypeReg,
 		}
+		switch {
+		case leaf.mode.IsDir():
+			if dirs[leaf.name] {
+				continue
+			}
+			dirs[leaf.name] = true
+			header.Name += "/"
+			header.Typeflag = tar.TypeDir
+		case leaf.mode&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = leaf.link
+		default:
+			header.Size = leaf.size()
+		}
 		if filepath.IsAbs(header.Name) {
 			header.Name = "." + header.Name
 		}
 		if err := out.WriteHeader(&header); err != nil {
-			return nil, nil, 0, fmt.Errorf("can't write header of %s to data.tar.gz: %v", leaf.name, err)
+			return nil, fmt.Errorf("can't write header of %s to data.tar: %v", leaf.name, err)
 		}
-		n, err := out.Write(leaf.data)
-		if err != nil {
-			return nil, nil, 0, fmt.Errorf("can't write data of %s to data.tar.gz: %v", leaf.name, err)
+		if header.Typeflag == tar.TypeReg {
+			digest.Reset()
+			if _, err := leaf.copyTo(io.MultiWriter(out, digest)); err != nil {
+				return nil, fmt.Errorf("can't write data of %s to data.tar: %v", leaf.name, err)
+			}
+			fmt.Fprintf(md5buf, "%x  %s\n", digest.Sum(nil), leaf.name)
 		}
-		size += int64(n)
 	}
 
 	if err := out.Close(); err != nil {
-		return nil, nil, 0, fmt.Errorf("can't close data.tar.gz: %v", err)
+		return nil, fmt.Errorf("can't close data.tar: %v", err)
 	}
 	if err := zip.Close(); err != nil {
-		return nil, nil, 0, fmt.Errorf("can't close data.tar.gz compressor: %v", err)
+		return nil, fmt.Errorf("can't close data.tar compressor: %v", err)
 	}
 
-	return buf.Bytes(), md5buf.Bytes(), size, nil
+	return md5buf.Bytes(), nil
 }
 
 func (d *Deb) createControlTarball(now time.Time, size int64, md5sums []byte) ([]byte, error) {
 	var (
-		data = []byte(d.control(size / 1024))
-		buf  = new(bytes.Buffer)
-		zip  = gzip.NewWriter(buf)
-		out  = tar.NewWriter(zip)
+		data      = []byte(d.control(size / 1024))
+		conffiles = new(bytes.Buffer)
+		buf       = new(bytes.Buffer)
 	)
 
-	header := tar.Header{
-		Name:     "./control",
-		Size:     int64(len(data)),
-		Mode:     0644,
-		ModTime:  now,
-		Typeflag: tar.TypeReg,
-	}
-	if err := out.WriteHeader(&header); err != nil {
-		return nil, fmt.Errorf("can't write header of control file to control.tar.gz: %v", err)
+	_, compression, level := d.member("control")
+	zip, err := newCompressor(buf, compression, level)
+	if err != nil {
+		return nil, err
 	}
-	if _, err := out.Write(data); err != nil {
-		return nil, fmt.Errorf("can't write control file to control.tar.gz: %v", err)
+	out := tar.NewWriter(zip)
+
+	for _, leaf := range d.tree.sorted() {
+		if leaf.config {
+			conffiles.WriteString(leaf.name + "\n")
+		}
 	}
 
-	header = tar.Header{
-		Name:     "./md5sums",
-		Size:     int64(len(md5sums)),
-		Mode:     0644,
-		ModTime:  now,
-		Typeflag: tar.TypeReg,
+	if err := addTarFile(now, out, "./control", 0644, data); err != nil {
+		return nil, fmt.Errorf("can't write control file to control.tar: %v", err)
 	}
-	if err := out.WriteHeader(&header); err != nil {
-		return nil, fmt.Errorf("can't write header of md5sums file to control.tar.gz: %v", err)
+	if err := addTarFile(now, out, "./md5sums", 0644, md5sums); err != nil {
+		return nil, fmt.Errorf("can't write md5sums file to control.tar: %v", err)
+	}
+	if conffiles.Len() > 0 {
+		if err := addTarFile(now, out, "./conffiles", 0644, conffiles.Bytes()); err != nil {
+			return nil, fmt.Errorf("can't write conffiles file to control.tar: %v", err)
+		}
 	}
-	if _, err := out.Write(md5sums); err != nil {
-		return nil, fmt.Errorf("can't write md5sums file to control.tar.gz: %v", err)
+	for _, phase := range scriptPhases {
+		if script, ok := d.Scripts[phase]; ok {
+			if err := addTarFile(now, out, "./"+phase, 0755, []byte(script)); err != nil {
+				return nil, fmt.Errorf("can't write %s script to control.tar: %v", phase, err)
+			}
+		}
 	}
 
 	if err := out.Close(); err != nil {
-		return nil, fmt.Errorf("closing control.tar.gz: %v", err)
+		return nil, fmt.Errorf("closing control.tar: %v", err)
 	}
 	if err := zip.Close(); err != nil {
-		return nil, fmt.Errorf("closing control.tar.gz: %v", err)
+		return nil, fmt.Errorf("closing control.tar: %v", err)
 	}
 
 	return buf.Bytes(), nil
@@ -250,6 +352,49 @@ func addArFile(now time.Time, w *ar.Writer, name string, body []byte) error {
 	return err
 }
 
+// addArStream adds the contents of f as a member. The data is written to out
+// directly, as ar.Writer pads every odd sized write.
+func addArStream(now time.Time, w *ar.Writer, out io.Writer, name string, f *os.File) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := ar.Header{
+		Name:    name,
+		Size:    size,
+		Mode:    0644,
+		ModTime: now,
+	}
+	if err = w.WriteHeader(&header); err != nil {
+		return fmt.Errorf("can't write ar header: %v", err)
+	}
+	if _, err = io.CopyN(out, f, size); err != nil {
+		return err
+	}
+	if size%2 == 1 {
+		_, err = out.Write([]byte{'\n'})
+	}
+	return err
+}
+
+func addTarFile(now time.Time, w *tar.Writer, name string, mode int64, body []byte) error {
+	header := tar.Header{
+		Name:     name,
+		Size:     int64(len(body)),
+		Mode:     mode,
+		ModTime:  now,
+		Typeflag: tar.TypeReg,
+	}
+	if err := w.WriteHeader(&header); err != nil {
+		return fmt.Errorf("can't write tar header: %v", err)
+	}
+	_, err := w.Write(body)
+	return err
+}
+
 func addTarDir(now time.Time, w *tar.Writer, name string, dirs map[string]bool) error {
 	if !dirs[name] {
 		var (
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lines of output included in the error of a failed generate step.
+const generateErrorLines = 20
+
+// GenerateStep is a command run before the files are collected. Steps are
+// given as a string, run with sh -c, as an argv array, or as an object:
+//
+//	{"run": "make", "env": {"CC": "gcc"}, "timeout": "10m"}
+//
+// where run is a string or an argv array. Commands, arguments and environment
+// values are templates, see templateData.
+type GenerateStep struct {
+	Run     string
+	Args    []string
+	Env     map[string]string
+	Timeout string
+	timeout time.Duration
+}
+
+func (s *GenerateStep) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &s.Run); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, &s.Args); err == nil {
+		if len(s.Args) == 0 {
+			return errors.New("generate: empty command")
+		}
+		return nil
+	}
+
+	var step struct {
+		Run     json.RawMessage
+		Env     map[string]string
+		Timeout string
+	}
+	if err := json.Unmarshal(b, &step); err != nil {
+		return errors.New("generate: expected a command, argv array or object")
+	}
+	if len(step.Run) == 0 {
+		return errors.New("generate: step without run")
+	}
+	if err := s.UnmarshalJSON(step.Run); err != nil {
+		return err
+	}
+	s.Env, s.Timeout = step.Env, step.Timeout
+	return nil
+}
+
+func (s GenerateStep) String() string {
+	if s.Args != nil {
+		return strings.Join(s.Args, " ")
+	}
+	return s.Run
+}
+
+// verify checks the step, and parses its timeout.
+func (s *GenerateStep) verify() error {
+	if s.Args == nil && strings.TrimSpace(s.Run) == "" {
+		return errors.New("generate: empty command")
+	}
+	if s.Timeout != "" {
+		var err error
+		if s.timeout, err = time.ParseDuration(s.Timeout); err != nil {
+			return fmt.Errorf("generate %q: invalid timeout: %v", s, err)
+		}
+	}
+	return nil
+}
+
+// command returns the templated command of the step.
+func (s GenerateStep) command(ctx context.Context, data templateData) (*exec.Cmd, error) {
+	if s.Args == nil {
+		run, err := expand(s.Run, data)
+		if err != nil {
+			return nil, err
+		}
+		return exec.CommandContext(ctx, "sh", "-c", run), nil
+	}
+
+	var args = make([]string, len(s.Args))
+	for i, arg := range s.Args {
+		var err error
+		if args[i], err = expand(arg, data); err != nil {
+			return nil, err
+		}
+	}
+	return exec.CommandContext(ctx, args[0], args[1:]...), nil
+}
+
+// generate runs the generate steps in the package directory. Output is streamed,
+// prefixed with the package name.
+func (pkg *Package) generate(platform Platform) error {
+	var data = pkg.templateData(platform)
+	for _, step := range pkg.Generate {
+		if err := pkg.generateStep(step, platform, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pkg *Package) generateStep(step GenerateStep, platform Platform, data templateData) error {
+	var ctx = context.Background()
+	if step.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, step.timeout)
+		defer cancel()
+	}
+
+	cmd, err := step.command(ctx, data)
+	if err != nil {
+		return fmt.Errorf("error running %q: %v", step, err)
+	}
+	cmd.Dir = pkg.dir()
+	// Children of sh may keep the output open after a timeout.
+	cmd.WaitDelay = time.Second
+
+	var env = append(os.Environ(), platform.Env()...)
+	for _, vars := range []map[string]string{pkg.Env, step.Env} {
+		var names = make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, err := expand(vars[name], data)
+			if err != nil {
+				return fmt.Errorf("error running %q: env %s: %v", step, name, err)
+			}
+			env = append(env, name+"="+value)
+		}
+	}
+	cmd.Env = env
+
+	var (
+		output = new(bytes.Buffer)
+		out    = &prefixWriter{w: os.Stdout, prefix: "[" + pkg.Name + "] "}
+		w      = io.MultiWriter(out, output)
+	)
+	cmd.Stdout, cmd.Stderr = w, w
+	err = cmd.Run()
+	out.Flush()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timeout after %s", step.timeout)
+		}
+		return fmt.Errorf("error running %q: %v%s", step, err, lastLines(output.String(), generateErrorLines))
+	}
+	return nil
+}
+
+// prefixWriter writes lines prefixed with prefix to w.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix string
+	line   []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range b {
+		p.line = append(p.line, c)
+		if c == '\n' {
+			if err := p.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes a final line without newline.
+func (p *prefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.line) == 0 {
+		return nil
+	}
+	p.line = append(p.line, '\n')
+	return p.flush()
+}
+
+func (p *prefixWriter) flush() error {
+	_, err := io.WriteString(p.w, p.prefix+string(p.line))
+	p.line = p.line[:0]
+	return err
+}
+
+// lastLines returns the last n lines of output, preceded by a newline, or an
+// empty string if there was no output.
+func lastLines(output string, n int) string {
+	var lines = strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return ""
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return "\n" + strings.Join(lines, "\n")
+}
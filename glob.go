@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// globFiles returns the files matching pattern, relative to base if the
+// pattern is not absolute. Patterns with ** match any number of directories,
+// and only return files, the directories they match are walked already.
+func globFiles(base, pattern string) ([]string, error) {
+	if filepath.IsAbs(pattern) {
+		pattern = filepath.Clean(pattern)
+	} else {
+		pattern = filepath.Join(base, pattern)
+	}
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+
+	// Walk from the directory before the first wildcard.
+	var (
+		slashed = filepath.ToSlash(pattern)
+		root    = globRoot(slashed)
+	)
+	re, err := regexp.Compile("^" + globExpr(slashed[len(root):]) + "$")
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	err = filepath.Walk(filepath.FromSlash(root), func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if rel := filepath.ToSlash(name)[len(root):]; re.MatchString(rel) {
+			matches = append(matches, name)
+		}
+		return nil
+	})
+	sort.Strings(matches)
+	return matches, err
+}
+
+// globRoot returns the literal directory of a slash separated pattern, before
+// the first wildcard, with a trailing slash.
+func globRoot(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?["); i >= 0 {
+		pattern = pattern[:i]
+	}
+	return pattern[:strings.LastIndex(pattern, "/")+1]
+}
+
+// destination returns the path of src in the package. The source key is
+// the expanded manifest key, matched by src, and rel is the path of src
+// relative to the package directory.
+//
+// A file is installed by its base name in the target, or at the target for a
+// dst of a list entry not ending in a slash. Like rsync(1), a directory is installed by its base name in the
+// target, and a key ending in a slash places the contents of the directory in
+// the target. With strip_prefix, sources keep their relative path after the
+// prefix. Files matched by ** keep their path below the literal directory of
+// the key. Rename replaces the base name, directly in the target.
+func (target *Target) destination(key, src, rel string, dir bool) (string, error) {
+	var name = filepath.ToSlash(rel)
+	switch {
+	case strings.HasSuffix(key, "/"):
+		if !dir {
+			return "", fmt.Errorf("%s: not a directory", src)
+		}
+		if target.Rename != "" {
+			return "", errors.New("rename of directory contents")
+		}
+		return target.Target, nil
+
+	case target.Rename != "":
+		return path.Join(target.Target, target.Rename), nil
+
+	case target.StripPrefix != "":
+		var prefix = strings.Trim(path.Clean(target.StripPrefix), "/")
+		if name == prefix {
+			name = ""
+		} else if strings.HasPrefix(name, prefix+"/") {
+			name = name[len(prefix)+1:]
+		} else {
+			return "", fmt.Errorf("%s: does not start with strip_prefix %s", rel, target.StripPrefix)
+		}
+		return path.Join(target.Target, name), nil
+
+	case strings.Contains(key, "**"):
+		if root := path.Clean(globRoot(filepath.ToSlash(key))); root != "." {
+			name = strings.TrimPrefix(name, strings.TrimSuffix(root, "/")+"/")
+		}
+		return path.Join(target.Target, name), nil
+
+	case target.exact && !dir && !strings.HasSuffix(target.Target, "/"):
+		return target.Target, nil
+
+	default:
+		return path.Join(target.Target, path.Base(name)), nil
+	}
+}
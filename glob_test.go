@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTargetDestination(t *testing.T) {
+	var tests = []struct {
+		name   string
+		target Target
+		key    string
+		rel    string
+		dir    bool
+		want   string
+		err    bool
+	}{
+		{"directory target", Target{Target: "/usr/bin"}, "build/bin/ship", "build/bin/ship", false, "/usr/bin/ship", false},
+		{"trailing slash", Target{Target: "/usr/bin/"}, "build/bin/ship", "build/bin/ship", false, "/usr/bin/ship", false},
+		{"exact dst", Target{Target: "/usr/lib/ship/ship-exact", exact: true}, "build/bin/ship", "build/bin/ship", false, "/usr/lib/ship/ship-exact", false},
+		{"exact dst with slash", Target{Target: "/usr/bin/", exact: true}, "build/bin/ship", "build/bin/ship", false, "/usr/bin/ship", false},
+		{"exact dst of directory", Target{Target: "/usr/share", exact: true}, "share/doc", "share/doc", true, "/usr/share/doc", false},
+		{"rename", Target{Target: "/usr/libexec", Rename: "ship-helper"}, "build/bin/ship", "build/bin/ship", false, "/usr/libexec/ship-helper", false},
+		{"directory", Target{Target: "/usr/share/"}, "share/doc", "share/doc", true, "/usr/share/doc", false},
+		{"directory contents", Target{Target: "/usr/share/doc/ship"}, "share/doc/", "share/doc", true, "/usr/share/doc/ship", false},
+		{"contents of file", Target{Target: "/usr/share"}, "README/", "README", false, "", true},
+		{"rename of contents", Target{Target: "/usr/share", Rename: "x"}, "share/", "share", true, "", true},
+		{"strip_prefix", Target{Target: "/usr/include", StripPrefix: "inc"}, "inc/**/*.h", "inc/a/h.h", false, "/usr/include/a/h.h", false},
+		{"strip_prefix mismatch", Target{Target: "/usr/include", StripPrefix: "src"}, "inc/*.h", "inc/h.h", false, "", true},
+		{"double star", Target{Target: "/opt/demo/"}, "dist/**", "dist/a/b/g", false, "/opt/demo/a/b/g", false},
+		{"double star dot", Target{Target: "/opt/demo"}, "./dist/**/g", "dist/c/g", false, "/opt/demo/c/g", false},
+		{"double star at root", Target{Target: "/opt/demo"}, "**/g", "dist/c/g", false, "/opt/demo/dist/c/g", false},
+		{"double star absolute", Target{Target: "/opt/demo"}, "/srv/dist/**", "/srv/dist/a/g", false, "/opt/demo/a/g", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.target.destination(test.key, test.rel, test.rel, test.dir)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGlobFiles(t *testing.T) {
+	var base = t.TempDir()
+	for _, name := range []string{"dist/top", "dist/a/b/g", "dist/c/g", "other/g"} {
+		var file = filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		pattern string
+		want    []string
+	}{
+		{"dist/*", []string{"dist/a", "dist/c", "dist/top"}},
+		{"dist/**", []string{"dist/a/b/g", "dist/c/g", "dist/top"}},
+		{"dist/**/g", []string{"dist/a/b/g", "dist/c/g"}},
+		{"**/g", []string{"dist/a/b/g", "dist/c/g", "other/g"}},
+		{"missing/**", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			matches, err := globFiles(base, test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, match := range matches {
+				rel, err := filepath.Rel(base, match)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, filepath.ToSlash(rel))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
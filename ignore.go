@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gogits/git-module"
+)
+
+// ignoreRule is a pattern with gitignore semantics, see gitignore(5).
+type ignoreRule struct {
+	re     *regexp.Regexp
+	negate bool
+	dir    bool
+}
+
+// ignoreRules match slash separated paths relative to the package directory.
+// The last matching rule decides if a path is ignored.
+type ignoreRules []ignoreRule
+
+func parseIgnoreRules(patterns []string) (ignoreRules, error) {
+	var rules ignoreRules
+	for _, pattern := range patterns {
+		rule, ok, err := parseIgnoreRule(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid: %v", pattern, err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// parseIgnoreRule parses a pattern, blank patterns and comments are skipped.
+func parseIgnoreRule(pattern string) (ignoreRule, bool, error) {
+	var rule ignoreRule
+
+	// Trailing spaces are ignored, unless escaped.
+	if p := strings.TrimRight(pattern, " "); strings.HasSuffix(p, "\\") && p != pattern {
+		pattern = p + " "
+	} else {
+		pattern = p
+	}
+	if pattern == "" || pattern[0] == '#' {
+		return rule, false, nil
+	}
+	if pattern[0] == '!' {
+		rule.negate, pattern = true, pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dir, pattern = true, strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return rule, false, nil
+	}
+
+	// Patterns with a slash at the start or in the middle are relative to the
+	// package directory, others match at any depth.
+	var expr string
+	if strings.Contains(pattern, "/") {
+		expr = "^" + globExpr(strings.TrimPrefix(pattern, "/")) + "$"
+	} else {
+		expr = "^(?:.*/)?" + globExpr(pattern) + "$"
+	}
+
+	var err error
+	rule.re, err = regexp.Compile(expr)
+	return rule, true, err
+}
+
+// globExpr translates a glob pattern to a regular expression. Wildcards don't
+// match a slash, except for ** which matches any number of directories.
+func globExpr(pattern string) string {
+	var expr string
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") &&
+				(i == 0 || pattern[i-1] == '/') &&
+				(i+2 == len(pattern) || pattern[i+2] == '/') {
+				if i+2 == len(pattern) {
+					// Trailing /** matches everything inside.
+					expr += ".*"
+				} else {
+					// Leading **/ and /**/ match zero or more directories.
+					expr += "(?:.*/)?"
+					i++
+				}
+				i++
+				continue
+			}
+			expr += "[^/]*"
+		case '?':
+			expr += "[^/]"
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr += `\[`
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + strings.Replace(class, `\`, `\\`, -1) + "]"
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				expr += regexp.QuoteMeta(pattern[i : i+1])
+			}
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	return expr
+}
+
+// match reports if any rule matches name, and if the last matching rule
+// ignores it.
+func (rules ignoreRules) match(name string, dir bool) (matched, ignored bool) {
+	for _, rule := range rules {
+		if rule.dir && !dir {
+			continue
+		}
+		if rule.re.MatchString(name) {
+			matched, ignored = true, !rule.negate
+		}
+	}
+	return
+}
+
+// ignored reports if name, or one of its parent directories, is ignored. Like
+// git, files in an ignored directory can't be included again.
+func (rules ignoreRules) ignored(name string, dir bool) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	var parts = strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if _, ignored := rules.match(strings.Join(parts[:i], "/"), true); ignored {
+			return true
+		}
+	}
+	_, ignored := rules.match(name, dir)
+	return ignored
+}
+
+// gitIgnored returns the untracked paths in dir ignored by git, directories
+// have a trailing slash.
+func gitIgnored(dir string) (map[string]bool, error) {
+	out, err := git.NewCommand("ls-files", "-z", "--others", "--ignored", "--exclude-standard", "--directory").RunInDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("gitignore: can't list ignored files in %s: %v", dir, err)
+	}
+	var ignored = make(map[string]bool)
+	for _, name := range strings.Split(out, "\x00") {
+		if name != "" {
+			ignored[name] = true
+		}
+	}
+	return ignored, nil
+}
+
+// ignored reports if the source is ignored by the package, the .gitignore of
+// the repository or the excludes of the manifest entry.
+func (pkg *Package) ignored(target *Target, src string, dir bool) bool {
+	name, err := filepath.Rel(pkg.dir(), src)
+	if err != nil || strings.HasPrefix(name, "..") {
+		// Outside of the package directory only patterns without slash match.
+		name = strings.TrimPrefix(src, string(filepath.Separator))
+	}
+	name = filepath.ToSlash(name)
+
+	if pkg.ignore.ignored(name, dir) || target.exclude.ignored(name, dir) {
+		return true
+	}
+	if pkg.gitignored != nil {
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if pkg.gitignored[p] || pkg.gitignored[p+"/"] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// jobs bounds the number of concurrently running build steps.
+type jobs chan struct{}
+
+func newJobs(n int) jobs {
+	if n < 1 {
+		n = 1
+	}
+	return make(jobs, n)
+}
+
+// run runs fn once a job slot is available.
+func (j jobs) run(fn func() error) error {
+	j <- struct{}{}
+	defer func() { <-j }()
+	return fn()
+}
+
+// errorList collects the errors of concurrent build steps.
+type errorList struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *errorList) add(err error) {
+	if err == nil {
+		return
+	}
+	l.mu.Lock()
+	l.errs = append(l.errs, err)
+	l.mu.Unlock()
+}
+
+// err returns nil if no errors were collected.
+func (l *errorList) err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch len(l.errs) {
+	case 0:
+		return nil
+	case 1:
+		return l.errs[0]
+	default:
+		return multiError(append([]error(nil), l.errs...))
+	}
+}
+
+type multiError []error
+
+func (m multiError) Error() string {
+	var s = make([]string, len(m))
+	for i, err := range m {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
@@ -3,10 +3,11 @@ package main
 
 import (
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -15,76 +16,199 @@ var supportedFormats = map[string]bool{
 	"rpm": true,
 }
 
+// Config is the ship config. Unknown keys are rejected, except top level keys
+// starting with x-, which may hold YAML anchors.
 type Config struct {
 	Package map[string]Package
 	Meta    Meta
 }
 
-type Manifest map[string]json.RawMessage
+// Manifest maps source patterns to targets. It is given as an object keyed by
+// source, processed in sorted order, or as a list of entries with src and dst,
+// processed in order. Later entries for the same source override earlier ones.
+type Manifest []ManifestEntry
+
+type ManifestEntry struct {
+	Source string
+	Target Target
+}
+
+// manifestListEntry is an entry of the list form of the manifest.
+type manifestListEntry struct {
+	Src string
+	Dst string
+	Target
+}
+
+func (m *Manifest) UnmarshalJSON(b []byte) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal(b, &list); err == nil {
+		for i, raw := range list {
+			var entry manifestListEntry
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return fmt.Errorf("manifest entry %d: %v", i+1, err)
+			}
+			if entry.Src == "" {
+				return fmt.Errorf("manifest entry %d: no src", i+1)
+			}
+			if entry.Dst != "" {
+				entry.Target.Target, entry.Target.exact = entry.Dst, true
+			}
+			*m = append(*m, ManifestEntry{Source: entry.Src, Target: entry.Target})
+		}
+		return nil
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return errors.New("manifest: expected an object or a list")
+	}
+	var sources = make([]string, 0, len(entries))
+	for source := range entries {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		var target Target
+		if err := json.Unmarshal(entries[source], &target); err != nil {
+			if err = json.Unmarshal(entries[source], &target.Target); err != nil {
+				return fmt.Errorf("manifest %s: can't unmarshal target", source)
+			}
+		}
+		*m = append(*m, ManifestEntry{Source: source, Target: target})
+	}
+	return nil
+}
+
+// Manifest entry types.
+const (
+	typeFile    = "file"
+	typeDir     = "dir"
+	typeSymlink = "symlink"
+)
 
 type Target struct {
-	Config bool
-	Target string
-	Mode   string
+	Config    bool
+	NoReplace bool
+	Target    string
+	Type      string
+	Mode      string
+	Owner     string
+	Group     string
+
+	// StripPrefix is removed from the source paths, Rename replaces the name
+	// of a single source. See Target.destination.
+	StripPrefix string `json:"strip_prefix"`
+	Rename      string
+
+	// Exclude has gitignore patterns of sources to skip, relative to the
+	// package directory.
+	Exclude []string
+	exclude ignoreRules
+
+	// exact is set for the dst of list entries, which is the path of a file
+	// source unless it ends in a slash. Other targets are directories.
+	exact bool
 }
 
-func showError(s string, err error) {
-	syntax, ok := err.(*json.SyntaxError)
-	if !ok {
+// showError shows err in the config s of file name, followed by the line
+// where it occurred, if known.
+func showError(name, s string, err error) {
+	var line, col int
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		line, col = offsetPosition(s, err.Offset)
+	case *json.UnmarshalTypeError:
+		line, col = offsetPosition(s, err.Offset)
+	case *positionError:
+		line, col = err.line, err.col
+	default:
+		fmt.Printf("error parsing %q: %v\n", name, err)
 		return
 	}
 
-	start, end := strings.LastIndex(s[:syntax.Offset], "\n")+1, len(s)
-	if idx := strings.Index(s[start:], "\n"); idx >= 0 {
-		end = start + idx
-	}
-	if start >= end {
-		fmt.Printf("Error at end of file")
+	var lines = strings.Split(s, "\n")
+	if line < 1 || line > len(lines) {
+		fmt.Printf("error parsing %q at end of file: %v\n", name, err)
 		return
 	}
-	line, pos := strings.Count(s[:start], "\n"), int(syntax.Offset)-start-1
-	fmt.Printf("Error in line %d: %s \n", line, err)
-	fmt.Printf("%s\n%s^", s[start:end], strings.Repeat(" ", pos))
+	fmt.Printf("error parsing %q in line %d: %v\n", name, line, err)
+	fmt.Println(lines[line-1])
+	if col > 0 {
+		fmt.Printf("%s^\n", strings.Repeat(" ", col-1))
+	}
 }
 
-func main() {
-	configFile := flag.String("config", "ship.json", "Ship config")
-	flag.Parse()
+// offsetPosition returns the line and column of the byte before offset.
+func offsetPosition(s string, offset int64) (int, int) {
+	if offset < 1 || offset > int64(len(s)) {
+		return 0, 0
+	}
+	var (
+		before = s[:offset-1]
+		start  = strings.LastIndex(before, "\n") + 1
+	)
+	return strings.Count(before, "\n") + 1, len(before) - start + 1
+}
 
-	f, err := os.Open(*configFile)
+// loadConfig reads and parses the config file, exiting on errors.
+func loadConfig(configFile string) *Config {
+	f, err := os.Open(configFile)
 	if err != nil {
-		fmt.Printf("error opening %q: %v\n", *configFile, err)
+		fmt.Printf("error opening %q: %v\n", configFile, err)
 		os.Exit(1)
 	}
 	defer f.Close()
 
 	b, err := ioutil.ReadAll(f)
 	if err != nil {
-		fmt.Printf("error reading %q: %v\n", *configFile, err)
+		fmt.Printf("error reading %q: %v\n", configFile, err)
 		os.Exit(2)
 	}
 
 	c := new(Config)
-	if err := json.Unmarshal(b, c); err != nil {
-		fmt.Printf("error parsing %q: %v\n", *configFile, err)
-		showError(string(b), err)
+	if errs := decodeConfig(configFile, b, c); len(errs) > 0 {
+		for _, err := range errs {
+			showError(configFile, string(b), err)
+		}
 		os.Exit(2)
 	}
 
 	if len(c.Package) == 0 {
-		fmt.Printf("error parsing %q: no packages defined\n", *configFile)
+		fmt.Printf("error parsing %q: no packages defined\n", configFile)
 		os.Exit(2)
 	}
 
-	for name, pkg := range c.Package {
-		if err := pkg.Verify(name, c.Meta); err != nil {
-			fmt.Println("  error:", err)
-			os.Exit(1)
-		}
-		fmt.Println("building", name, pkg.Version)
-		if err := pkg.Build(); err != nil {
-			fmt.Println("  error:", err)
-			os.Exit(1)
-		}
+	return c
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %s [command] [flags] [package...]
+
+commands:
+  build     build packages (default)
+  list      list packages, versions and output names
+  validate  parse the config and verify all packages
+  contents  print the files of a package
+  schema    print the JSON Schema of the config
+
+Run "%s <command> -h" for the flags of a command.
+`, os.Args[0], os.Args[0])
+}
+
+func main() {
+	var (
+		name = "build"
+		args = os.Args[1:]
+	)
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
 	}
+	os.Exit(cmd(args))
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+const defaultOS = "linux"
+
+// Platform is an entry in the build matrix of a package. OS defaults to, and
+// must be, linux.
+type Platform struct {
+	OS   string
+	Arch string
+	CGO  bool
+
+	// env is set if the generate commands run for this platform, and not for
+	// the host.
+	env bool
+}
+
+func (p Platform) String() string {
+	return p.OS + "/" + p.Arch
+}
+
+// Env returns the Go environment for generate commands.
+func (p Platform) Env() []string {
+	if !p.env {
+		return nil
+	}
+	var env = []string{
+		"GOOS=" + p.OS,
+		"GOARCH=" + p.Arch,
+		"CGO_ENABLED=0",
+	}
+	if p.CGO {
+		env[2] = "CGO_ENABLED=1"
+	}
+	if p.Arch == "arm" {
+		// armhf requires ARMv7
+		env = append(env, "GOARM=7")
+	}
+	return env
+}
+
+// templateData is available to templated manifest entries and output names.
+// Output names use the architecture name of the package format.
+type templateData struct {
+	Name    string
+	Version string
+	Release string
+	OS      string
+	Arch    string
+}
+
+// expand executes s as a template with data.
+func expand(s string, data templateData) (string, error) {
+	t, err := template.New("").Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid template %q: %v", s, err)
+	}
+	var buf = new(bytes.Buffer)
+	if err = t.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("invalid template %q: %v", s, err)
+	}
+	return buf.String(), nil
+}
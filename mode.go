@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultOwner = "root"
+	defaultGroup = "root"
+)
+
+// parseMode applies a mode specification to mode. The specification is either
+// an octal mode such as "0755", or a comma separated list of symbolic clauses
+// such as "u+x,go-w" as accepted by chmod(1).
+func parseMode(spec string, mode os.FileMode) (os.FileMode, error) {
+	if spec == "" {
+		return mode, nil
+	}
+
+	if spec[0] >= '0' && spec[0] <= '7' {
+		n, err := strconv.ParseUint(spec, 8, 32)
+		if err != nil || n > 07777 {
+			return mode, fmt.Errorf("invalid mode %q", spec)
+		}
+		return mode&^(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) | goMode(uint32(n)), nil
+	}
+
+	var bits = unixMode(mode) &^ modeIFMT
+	for _, clause := range strings.Split(spec, ",") {
+		var (
+			who uint32
+			i   int
+		)
+	who:
+		for ; i < len(clause); i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 04700
+			case 'g':
+				who |= 02070
+			case 'o':
+				who |= 01007
+			case 'a':
+				who |= 07777
+			default:
+				break who
+			}
+		}
+		if who == 0 {
+			who = 07777
+		}
+		if i == len(clause) {
+			return mode, fmt.Errorf("invalid mode %q: missing operator", spec)
+		}
+
+		var op = clause[i]
+		if op != '+' && op != '-' && op != '=' {
+			return mode, fmt.Errorf("invalid mode %q: unknown operator %q", spec, op)
+		}
+
+		var perm uint32
+		for _, char := range clause[i+1:] {
+			switch char {
+			case 'r':
+				perm |= 0444
+			case 'w':
+				perm |= 0222
+			case 'x':
+				perm |= 0111
+			case 'X':
+				if mode.IsDir() || bits&0111 != 0 {
+					perm |= 0111
+				}
+			case 's':
+				perm |= 06000
+			case 't':
+				perm |= 01000
+			default:
+				return mode, fmt.Errorf("invalid mode %q: unknown permission %q", spec, char)
+			}
+		}
+		perm &= who
+
+		switch op {
+		case '+':
+			bits |= perm
+		case '-':
+			bits &^= perm
+		case '=':
+			bits = bits&^who | perm
+		}
+	}
+
+	return mode&^(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) | goMode(bits), nil
+}
+
+// goMode converts Unix permission bits to a Go file mode.
+func goMode(bits uint32) os.FileMode {
+	var mode = os.FileMode(bits) & os.ModePerm
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// unixMode converts a Go file mode to a Unix st_mode.
+func unixMode(mode os.FileMode) uint32 {
+	var bits = uint32(mode.Perm())
+	switch {
+	case mode&os.ModeDir != 0:
+		bits |= modeIFDIR
+	case mode&os.ModeSymlink != 0:
+		bits |= modeIFLNK
+	default:
+		bits |= modeIFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// lookupOwner returns the user name and id for owner, which is either a user
+// name or a numeric id. Names unknown to the build host map to id 0, package
+// managers resolve the name on the target system. If resolve is false, the
+// user database of the build host is not consulted.
+func lookupOwner(owner string, resolve bool) (string, int) {
+	if owner == "" {
+		return defaultOwner, 0
+	}
+	if id, err := strconv.Atoi(owner); err == nil {
+		if !resolve {
+			return owner, id
+		}
+		if u, err := user.LookupId(owner); err == nil {
+			return u.Username, id
+		}
+		return owner, id
+	}
+	if !resolve {
+		return owner, 0
+	}
+	if u, err := user.Lookup(owner); err == nil {
+		id, _ := strconv.Atoi(u.Uid)
+		return owner, id
+	}
+	return owner, 0
+}
+
+// lookupGroup is like lookupOwner, for groups.
+func lookupGroup(group string, resolve bool) (string, int) {
+	if group == "" {
+		return defaultGroup, 0
+	}
+	if id, err := strconv.Atoi(group); err == nil {
+		if !resolve {
+			return group, id
+		}
+		if g, err := user.LookupGroupId(group); err == nil {
+			return g.Name, id
+		}
+		return group, id
+	}
+	if !resolve {
+		return group, 0
+	}
+	if g, err := user.LookupGroup(group); err == nil {
+		id, _ := strconv.Atoi(g.Gid)
+		return group, id
+	}
+	return group, 0
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/gogits/git-module"
 	"github.com/mcuadros/go-version"
@@ -25,96 +27,367 @@ type Package struct {
 	Repo     string
 	Branch   string
 	Version  string
-	Generate []string
+
+	// Epoch and Release complete the version, Release defaults to 1. RPMDist
+	// is appended to the RPM release, for example ".el9".
+	Epoch   int
+	Release string
+	RPMDist string `json:"rpm-dist"`
+
+	// TagPattern selects the tags used by the git-tag and git-describe
+	// versions, its literal prefix is stripped from the tag, as is a leading v.
+	TagPattern string `json:"tag-pattern"`
+
+	// Architecture is a Go, Debian or RPM architecture name, or "all" for
+	// architecture independent packages. Defaults to the host architecture.
+	Architecture string
+
+	// Matrix builds the package for each platform, with the generate commands
+	// running in a Go cross compilation environment for the platform. If
+	// Architecture is set, only matching platforms are built.
+	Matrix []Platform
+
+	Generate []GenerateStep
+	Scripts  Scripts
 	Formats  []string
 	Ignore   []string
-	ignore   []*regexp.Regexp
+	ignore   ignoreRules
+
+	// Ignore has gitignore patterns relative to the package directory. If
+	// GitIgnore is set, files ignored by git are skipped as well.
+	GitIgnore  bool `json:"gitignore"`
+	gitignored map[string]bool
+
+	// Env is added to the environment of the generate steps.
+	Env map[string]string
+
+	// OutputDir is the directory packages are written to, defaults to the
+	// working directory. OutputName maps a format to a template for the file
+	// name of its packages, with the format's architecture name as Arch.
+	OutputDir  string            `json:"output_dir"`
+	OutputName map[string]string `json:"output_name"`
+
+	// Compression of deb members and the RPM payload: gzip, bzip2, xz, zstd
+	// or none. The default level of the compressor is used if the level is 0.
+	Compression      string
+	CompressionLevel int `json:"compression-level"`
+
+	// Reproducible builds use the commit time of Branch for all timestamps,
+	// unless SOURCE_DATE_EPOCH is set.
+	Reproducible bool
+	sourceDate   time.Time
+
+	// Checkout builds from a clone of Repo at Branch, which may also be a tag
+	// or commit, instead of the working tree. Generate steps run and manifest
+	// globs resolve in the clone, script and version files are read at Branch.
+	// If Path is inside the work tree of Repo, its location is kept.
+	Checkout bool
+	checkout string
+	subdir   string
 }
 
-func (pkg *Package) Build() error {
-	if pkg.Generate != nil {
-		for _, run := range pkg.Generate {
-			base, args := command(run)
-			cmd := exec.Command(base, args...)
-			out := new(bytes.Buffer)
-			cmd.Stdout = out
-			err := cmd.Run()
-			if err != nil {
-				return fmt.Errorf("error running %q: %v", run, err)
+// Build builds the package for all platforms. The formats of a platform are
+// built concurrently, bounded by j, from a tree that is collected once. All
+// platforms are built, even if one fails.
+func (pkg *Package) Build(j jobs) error {
+	cleanup, err := pkg.clone()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var errs errorList
+	for _, platform := range pkg.platforms() {
+		if !platform.env {
+			errs.add(pkg.buildPlatform(j, platform))
+			continue
+		}
+		fmt.Println("  platform", platform)
+		if err := pkg.buildPlatform(j, platform); err != nil {
+			errs.add(fmt.Errorf("%s: %v", platform, err))
+		}
+	}
+	return errs.err()
+}
+
+// clone checks out Repo at Branch in a temporary directory if the package is
+// built from a checkout. The returned function removes the checkout.
+func (pkg *Package) clone() (func(), error) {
+	if !pkg.Checkout {
+		return func() {}, nil
+	}
+	dir, err := ioutil.TempDir("", "ship-"+pkg.Name+"-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+		pkg.checkout = ""
+	}
+	if err = git.Clone(pkg.Repo, dir, git.CloneRepoOptions{Quiet: true}); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("can't clone %s: %v", pkg.Repo, err)
+	}
+	if err = git.Checkout(dir, git.CheckoutOptions{Branch: pkg.Branch}); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("can't check out %s of %s: %v", pkg.Branch, pkg.Repo, err)
+	}
+	fmt.Println("  checkout", pkg.Branch, "of", pkg.Repo)
+	pkg.checkout = dir
+	return cleanup, nil
+}
+
+// dir returns the directory generate steps run and manifest globs resolve in.
+func (pkg *Package) dir() string {
+	if pkg.checkout != "" {
+		return filepath.Join(pkg.checkout, pkg.subdir)
+	}
+	return pkg.Path
+}
+
+// repoSubdir returns the location of Path in the work tree of Repo, or an
+// empty string if it is the top or outside of it, like for a bare Repo.
+func (pkg *Package) repoSubdir() string {
+	top, err := git.NewCommand("rev-parse", "--show-toplevel").RunInDir(pkg.Repo)
+	if err != nil {
+		return ""
+	}
+	dir, err := filepath.EvalSymlinks(pkg.Path)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(strings.TrimSpace(top), dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// platforms returns the matrix of the package, or the platform of its
+// architecture if there is no matrix.
+func (pkg *Package) platforms() []Platform {
+	if len(pkg.Matrix) > 0 {
+		return pkg.Matrix
+	}
+	return []Platform{{OS: defaultOS, Arch: pkg.Architecture}}
+}
+
+func (pkg *Package) buildPlatform(j jobs, platform Platform) error {
+	var t tree
+
+	if err := j.run(func() error {
+		if err := pkg.generate(platform); err != nil {
+			return err
+		}
+		var err error
+		if t, err = pkg.collect(platform); err != nil {
+			return err
+		}
+		for _, l := range t.sorted() {
+			if l.mode&os.ModeSymlink != 0 {
+				fmt.Printf("%s %s -> %s\n", l.mode.String(), l.name, l.link)
+			} else {
+				fmt.Printf("%s %s\n", l.mode.String(), l.name)
 			}
 		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
+	// Files are read when the archives are written, all formats must be done
+	// before the generate commands of the next platform run.
+	var (
+		wg   sync.WaitGroup
+		errs errorList
+	)
 	for _, format := range pkg.Formats {
-		var (
-			out Archive
-			err error
-		)
-		switch format {
-		case "deb":
-			out = NewDeb(pkg.Name, pkg.Version)
-		case "rpm":
-			out, err = NewRPM(pkg.Name, pkg.Version)
-		default:
-			return fmt.Errorf("ship: unsupported format %q", format)
+		out, err := pkg.archive(format, platform)
+		if err != nil {
+			errs.add(err)
+			continue
 		}
+		name, err := pkg.output(format, out, platform)
 		if err != nil {
-			return err
+			errs.add(err)
+			continue
 		}
-		if err = pkg.build(out); err != nil {
-			return err
+		wg.Add(1)
+		go func(out Archive, name string) {
+			defer wg.Done()
+			errs.add(j.run(func() error {
+				return pkg.build(out, name, t)
+			}))
+		}(out, name)
+	}
+	wg.Wait()
+
+	return errs.err()
+}
+
+// archive returns an empty archive in format for platform.
+func (pkg *Package) archive(format string, platform Platform) (Archive, error) {
+	switch format {
+	case "deb":
+		d, err := NewDeb(pkg.Name, pkg.Version, platform.Arch)
+		if err != nil {
+			return nil, err
 		}
+		d.Epoch, d.Revision = pkg.Epoch, pkg.Release
+		return d, nil
+	case "rpm":
+		r, err := NewRPM(pkg.Name, pkg.Version, platform.Arch)
+		if err != nil {
+			return nil, err
+		}
+		r.Epoch, r.Release = pkg.Epoch, pkg.Release+pkg.RPMDist
+		return r, nil
+	default:
+		return nil, fmt.Errorf("ship: unsupported format %q", format)
 	}
+}
 
-	return nil
+// output returns the path of the package file for archive out.
+func (pkg *Package) output(format string, out Archive, platform Platform) (string, error) {
+	var name = out.Name()
+	if tmpl, ok := pkg.OutputName[format]; ok {
+		var (
+			data = out.NameData()
+			err  error
+		)
+		data.OS = platform.OS
+		if name, err = expand(tmpl, data); err != nil {
+			return "", fmt.Errorf("output_name %s: %v", format, err)
+		}
+		if name == "" {
+			return "", fmt.Errorf("output_name %s: empty file name", format)
+		}
+	}
+	return filepath.Join(pkg.OutputDir, name), nil
 }
 
-func (pkg *Package) build(out Archive) error {
-	if pkg.Manifest == nil || len(pkg.Manifest) == 0 {
-		return errors.New("empty manifest")
+func (pkg *Package) templateData(platform Platform) templateData {
+	return templateData{
+		Name:    pkg.Name,
+		Version: pkg.Version,
+		Release: pkg.Release,
+		OS:      platform.OS,
+		Arch:    platform.Arch,
 	}
+}
 
-	if err := out.ParseMeta(pkg.Meta); err != nil {
-		return err
+// collect returns the tree of files in the manifest.
+func (pkg *Package) collect(platform Platform) (tree, error) {
+	if pkg.Manifest == nil || len(pkg.Manifest) == 0 {
+		return nil, errors.New("empty manifest")
 	}
 
 	var (
-		f   *os.File
-		fi  os.FileInfo
-		err error
+		t    = make(tree)
+		fi   os.FileInfo
+		data = pkg.templateData(platform)
 	)
 
-	for pattern, rawTarget := range pkg.Manifest {
-		target, err := pkg.parseTarget(rawTarget)
+	if pkg.GitIgnore {
+		var err error
+		if pkg.gitignored, err = gitIgnored(pkg.dir()); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range pkg.Manifest {
+		var (
+			pattern = entry.Source
+			target  = entry.Target
+		)
+		if err := pkg.verifyTarget(&target); err != nil {
+			return nil, errors.New(pattern + ": " + err.Error())
+		}
+		var err error
+		if target.Target, err = expand(target.Target, data); err != nil {
+			return nil, errors.New(pattern + ": " + err.Error())
+		}
+
+		glob, err := expand(pattern, data)
 		if err != nil {
-			return errors.New(pattern + ": " + err.Error())
+			return nil, errors.New(pattern + ": " + err.Error())
+		}
+		if target.Type != typeFile {
+			if err = pkg.addEntry(t, &target, glob); err != nil {
+				return nil, errors.New(pattern + ": " + err.Error())
+			}
+			continue
 		}
 
-		source, err := filepath.Glob(pattern)
+		var base string
+		if !filepath.IsAbs(glob) {
+			base = pkg.dir()
+		}
+		source, err := globFiles(base, glob)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(source) == 0 {
-			return errors.New(pattern + ": did not match any files")
+			return nil, errors.New(glob + ": did not match any files")
+		}
+		if target.Rename != "" && len(source) > 1 {
+			return nil, fmt.Errorf("%s: rename of %d files", glob, len(source))
 		}
 
 		for _, src := range source {
-			if fi, err = os.Stat(src); err != nil {
-				return err
+			if fi, err = os.Lstat(src); err != nil {
+				return nil, err
 			}
-			var dst = filepath.Join(target.Target, src)
-			if err := pkg.add(out, dst, src, fi.Mode()); err != nil {
-				return err
+			// Relative globs keep their path relative to the package.
+			var rel = src
+			if base != "" {
+				if rel, err = filepath.Rel(base, src); err != nil {
+					return nil, err
+				}
+			}
+			dst, err := target.destination(glob, src, rel, fi.IsDir())
+			if err != nil {
+				return nil, errors.New(pattern + ": " + err.Error())
+			}
+			if err := pkg.add(t, &target, dst, src, fi.Mode()); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	fmt.Printf("           %s\n", out.Name())
-	if f, err = os.Create(out.Name()); err != nil {
+	return t, nil
+}
+
+// build writes the files in t to the archive out, stored as name.
+func (pkg *Package) build(out Archive, name string, t tree) error {
+	if err := out.ParseMeta(pkg.Meta); err != nil {
+		return err
+	}
+	out.AddScripts(pkg.Scripts)
+	if err := out.SetCompression(pkg.Compression, pkg.CompressionLevel); err != nil {
+		return err
+	}
+	if !pkg.sourceDate.IsZero() {
+		out.SetSourceDate(pkg.sourceDate)
+	}
+	for _, l := range t {
+		out.Add(l)
+	}
+
+	var (
+		f   *os.File
+		err error
+	)
+
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	if f, err = os.Create(name); err != nil {
 		return err
 	}
 
 	if err = out.WriteTo(f); err != nil {
+		f.Close()
 		return err
 	}
 
@@ -122,10 +395,11 @@ func (pkg *Package) build(out Archive) error {
 		return err
 	}
 
+	fmt.Printf("           %s\n", name)
 	return nil
 }
 
-func (pkg *Package) add(out Archive, dst, src string, mode os.FileMode) error {
+func (pkg *Package) add(t tree, target *Target, dst, src string, mode os.FileMode) error {
 	var (
 		fi  os.FileInfo
 		err error
@@ -135,56 +409,122 @@ func (pkg *Package) add(out Archive, dst, src string, mode os.FileMode) error {
 			return err
 		}
 	}
-	if pkg.ignored(src) {
+	if fi, err = os.Lstat(src); err != nil {
+		return err
+	}
+	if pkg.ignored(target, src, fi.IsDir()) {
 		fmt.Printf("< ignore > %s\n", dst)
 		return nil
 	}
-	if fi, err = os.Stat(src); err != nil {
-		return err
-	}
 	if fi.IsDir() {
-		return filepath.Walk(src, func(childSrc string, fi os.FileInfo, err2 error) error {
-			if pkg.ignored(childSrc) || childSrc == src {
+		return filepath.Walk(src, func(childSrc string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if childSrc == src {
+				return nil
+			}
+			if pkg.ignored(target, childSrc, fi.IsDir()) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 			var childDst = dst + childSrc[len(src):]
-			return pkg.add(out, childDst, childSrc, fi.Mode())
+			if fi.IsDir() {
+				// Directories keep their mode, the walk continues with their
+				// contents.
+				return pkg.addLeaf(t, target, leaf{name: childDst, mode: fi.Mode(), mtime: fi.ModTime()})
+			}
+			return pkg.add(t, target, childDst, childSrc, fi.Mode())
 		})
 	}
-	fmt.Printf("%s %s\n", mode.String(), dst)
-	var (
-		f *os.File
-		b []byte
-	)
-	if f, err = os.Open(src); err != nil {
-		return err
+
+	var l = leaf{name: dst, mode: mode, mtime: fi.ModTime(), config: target.Config, noreplace: target.NoReplace}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if l.link, err = os.Readlink(src); err != nil {
+			return err
+		}
+		l.src = src
+		return pkg.addLeaf(t, target, l)
 	}
-	defer f.Close()
-	if b, err = ioutil.ReadAll(f); err != nil {
+
+	if l.mode, err = parseMode(target.Mode, mode); err != nil {
 		return err
 	}
-	out.Add(dst, mode, b)
+	l.src, l.filesize = src, fi.Size()
+	return pkg.addLeaf(t, target, l)
+}
+
+// addLeaf sets the ownership of l and adds it to the tree. Directories may be
+// added more than once, other leafs only from the same source. Names are made
+// absolute, relative destinations are relative to the root.
+func (pkg *Package) addLeaf(t tree, target *Target, l leaf) error {
+	l.name = path.Clean("/" + l.name)
+	if prev, ok := t[l.name]; ok && !(prev.mode.IsDir() && l.mode.IsDir()) {
+		if prev.src != l.src || prev.link != l.link || prev.mode.IsDir() != l.mode.IsDir() {
+			return fmt.Errorf("%s: both %s and %s are installed here", l.name, prev.source(), l.source())
+		}
+	}
+	l.owner, l.uid = lookupOwner(target.Owner, pkg.sourceDate.IsZero())
+	l.group, l.gid = lookupGroup(target.Group, pkg.sourceDate.IsZero())
+	t[l.name] = l
 	return nil
 }
 
-func (pkg *Package) ignored(name string) bool {
-	for _, re := range pkg.ignore {
-		if re.MatchString(name) {
-			return true
+// addEntry adds an explicitly declared directory or symlink. Directories are
+// created at the target, or the manifest key if the target is empty. Symlinks
+// are created at the target and point to the manifest key, like ln(1).
+func (pkg *Package) addEntry(t tree, target *Target, key string) error {
+	switch target.Type {
+	case typeDir:
+		var (
+			name = target.Target
+			mode = os.ModeDir | 0755
+			err  error
+		)
+		if name == "" {
+			name = key
+		}
+		if mode, err = parseMode(target.Mode, mode); err != nil {
+			return err
+		}
+		return pkg.addLeaf(t, target, leaf{name: path.Clean(name), mode: mode, mtime: pkg.sourceDate})
+
+	case typeSymlink:
+		if target.Target == "" {
+			return errors.New("symlink without target")
 		}
+		return pkg.addLeaf(t, target, leaf{
+			name:  path.Clean(target.Target),
+			mode:  os.ModeSymlink | 0777,
+			mtime: pkg.sourceDate,
+			link:  key,
+		})
+
+	default:
+		return fmt.Errorf("unsupported type %q", target.Type)
 	}
-	return false
 }
 
-func (pkg *Package) parseTarget(raw json.RawMessage) (*Target, error) {
-	var target = new(Target)
-	if err := json.Unmarshal(raw, target); err == nil {
-		return target, nil
+// verifyTarget checks the mode and type of the target, and parses its
+// excludes.
+func (pkg *Package) verifyTarget(target *Target) error {
+	if _, err := parseMode(target.Mode, 0); err != nil {
+		return err
 	}
-	if err := json.Unmarshal(raw, &target.Target); err == nil {
-		return target, nil
+	var err error
+	if target.exclude, err = parseIgnoreRules(target.Exclude); err != nil {
+		return fmt.Errorf("exclude: %v", err)
 	}
-	return nil, errors.New("can't unmarshal target")
+	switch target.Type {
+	case "":
+		target.Type = typeFile
+	case typeFile, typeDir, typeSymlink:
+	default:
+		return fmt.Errorf("unsupported type %q", target.Type)
+	}
+	return nil
 }
 
 func (pkg *Package) Verify(name string, meta Meta) error {
@@ -219,6 +559,56 @@ func (pkg *Package) Verify(name string, meta Meta) error {
 	if pkg.Branch == "" {
 		pkg.Branch = "master"
 	}
+	if pkg.Checkout {
+		pkg.subdir = pkg.repoSubdir()
+	}
+
+	if pkg.Scripts, err = pkg.Scripts.load(pkg.readFile); err != nil {
+		return err
+	}
+	for i := range pkg.Generate {
+		if err = pkg.Generate[i].verify(); err != nil {
+			return err
+		}
+	}
+	if pkg.Architecture == "" && len(pkg.Matrix) == 0 {
+		pkg.Architecture = runtime.GOARCH
+	}
+	if pkg.Architecture != "" {
+		if pkg.Architecture, err = parseArch(pkg.Architecture); err != nil {
+			return err
+		}
+	}
+	if len(pkg.Matrix) > 0 {
+		var (
+			matrix []Platform
+			seen   = make(map[string]bool)
+		)
+		for _, platform := range pkg.Matrix {
+			if platform.OS == "" {
+				platform.OS = defaultOS
+			}
+			// Package names don't include the OS, deb and rpm are Linux only.
+			if platform.OS != defaultOS {
+				return fmt.Errorf("matrix: unsupported OS %q, packages are built for %s", platform.OS, defaultOS)
+			}
+			if platform.Arch, err = parseArch(platform.Arch); err != nil {
+				return fmt.Errorf("matrix: %v", err)
+			}
+			if seen[platform.String()] {
+				return fmt.Errorf("matrix: duplicate platform %s", platform)
+			}
+			seen[platform.String()] = true
+			platform.env = true
+			if pkg.Architecture == "" || pkg.Architecture == platform.Arch {
+				matrix = append(matrix, platform)
+			}
+		}
+		if len(matrix) == 0 {
+			return fmt.Errorf("matrix has no platform for architecture %s", pkg.Architecture)
+		}
+		pkg.Matrix = matrix
+	}
 	if pkg.Formats == nil || len(pkg.Formats) == 0 {
 		pkg.Formats = make([]string, 0)
 		for format := range supportedFormats {
@@ -227,6 +617,15 @@ func (pkg *Package) Verify(name string, meta Meta) error {
 	}
 	sort.Strings(pkg.Formats)
 
+	for format, tmpl := range pkg.OutputName {
+		if !supportedFormats[format] {
+			return fmt.Errorf("output_name: unsupported format %q", format)
+		}
+		if _, err = template.New(format).Parse(tmpl); err != nil {
+			return fmt.Errorf("output_name %s: %v", format, err)
+		}
+	}
+
 	switch pkg.Version {
 	case "git":
 		if pkg.Version, err = pkg.gitVersion(); err != nil {
@@ -240,53 +639,181 @@ func (pkg *Package) Verify(name string, meta Meta) error {
 		}
 		break
 
+	case "git-describe":
+		if pkg.Version, err = pkg.gitDescribeVersion(); err != nil {
+			return err
+		}
+		break
+
 	case "":
 		return errors.New("empty version and no version detection method specified")
-	}
 
-	if pkg.Ignore != nil && len(pkg.Ignore) > 0 {
-		for _, glob := range pkg.Ignore {
-			var (
-				expr = "^"
-				re   *regexp.Regexp
-			)
-			for _, char := range glob {
-				switch char {
-				case '*':
-					expr += ".*"
-				case '?':
-					expr += "."
-				case '.':
-					expr += "\\."
-				default:
-					expr += string(char)
-				}
-			}
-			expr += "$"
-			if re, err = regexp.Compile(expr); err != nil {
-				return fmt.Errorf("%s: invalid: %v\n", glob, err)
-			}
-			pkg.ignore = append(pkg.ignore, re)
+	default:
+		if pkg.Version, err = pkg.sourceVersion(pkg.Version); err != nil {
+			return err
 		}
 	}
+	if err = pkg.verifyVersion(); err != nil {
+		return err
+	}
+
+	if pkg.Compression, pkg.CompressionLevel, err = parseCompression(pkg.Compression, pkg.CompressionLevel); err != nil {
+		return err
+	}
+
+	if pkg.sourceDate, err = pkg.buildSourceDate(); err != nil {
+		return err
+	}
+
+	if pkg.ignore, err = parseIgnoreRules(pkg.Ignore); err != nil {
+		return fmt.Errorf("ignore: %v", err)
+	}
 
 	return nil
 }
 
-func (pkg *Package) gitTagVersion() (string, error) {
+// buildSourceDate returns the timestamp for reproducible builds, taken from
+// SOURCE_DATE_EPOCH or the commit time of the branch. The zero time is returned
+// if the build is not reproducible.
+func (pkg *Package) buildSourceDate() (time.Time, error) {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %v", epoch, err)
+		}
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	if !pkg.Reproducible {
+		return time.Time{}, nil
+	}
+
 	repo, err := git.OpenRepository(pkg.Repo)
 	if err != nil {
+		return time.Time{}, fmt.Errorf("can't get git repository at %s: %v", pkg.Repo, err)
+	}
+
+	commit, err := pkg.branchCommit(repo)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return commit.Committer.When.UTC(), nil
+}
+
+// gitTagVersion returns the highest tag reachable from the branch.
+func (pkg *Package) gitTagVersion() (string, error) {
+	if _, err := git.OpenRepository(pkg.Repo); err != nil {
 		return "", fmt.Errorf("can't get git repository at %s: %v", pkg.Repo, err)
 	}
-	tags, err := repo.GetTags()
+	out, err := git.NewCommand("tag", "--merged", pkg.Branch, "--list", pkg.tagPattern()).RunInDir(pkg.Repo)
 	if err != nil {
-		return "", fmt.Errorf("can't get git tags: %v", err)
+		return "", fmt.Errorf("can't get git tags of %s at %s: %v", pkg.Branch, pkg.Repo, err)
 	}
+	var tags = strings.Fields(out)
 	if len(tags) == 0 {
-		return "", fmt.Errorf("not git tags in repository %s", pkg.Repo)
+		return "", fmt.Errorf("no git tags matching %q on %s in repository %s", pkg.tagPattern(), pkg.Branch, pkg.Repo)
+	}
+	for i, tag := range tags {
+		tags[i] = pkg.tagVersion(tag)
 	}
 	version.Sort(tags)
-	return tags[len(tags)-1], nil
+	return preRelease(tags[len(tags)-1]), nil
+}
+
+// gitDescribeVersion returns the nearest tag reachable from the branch. Commits
+// since the tag produce a snapshot version, like 1.4.0+git20261016.12.gabc1234,
+// that sorts after the tag and before the next release. Uncommitted changes in
+// the work tree add a .dirty suffix, see gitDirty.
+func (pkg *Package) gitDescribeVersion() (string, error) {
+	repo, err := git.OpenRepository(pkg.Repo)
+	if err != nil {
+		return "", fmt.Errorf("can't get git repository at %s: %v", pkg.Repo, err)
+	}
+	out, err := git.NewCommand("describe", "--tags", "--long", "--abbrev=7", "--match", pkg.tagPattern(), pkg.Branch).RunInDir(pkg.Repo)
+	if err != nil {
+		return "", fmt.Errorf("can't describe %s at %s: %v", pkg.Branch, pkg.Repo, err)
+	}
+
+	// The tag may contain dashes, the count and hash are the last fields.
+	var fields = strings.Split(strings.TrimSpace(out), "-")
+	if len(fields) < 3 {
+		return "", fmt.Errorf("can't parse git describe output %q", out)
+	}
+	var (
+		n    = len(fields)
+		tag  = strings.Join(fields[:n-2], "-")
+		hash = fields[n-1]
+	)
+	count, err := strconv.Atoi(fields[n-2])
+	if err != nil {
+		return "", fmt.Errorf("can't parse git describe output %q", out)
+	}
+
+	dirty, err := pkg.gitDirty()
+	if err != nil {
+		return "", err
+	}
+
+	var v = preRelease(pkg.tagVersion(tag))
+	if count == 0 && !dirty {
+		return v, nil
+	}
+	commit, err := pkg.branchCommit(repo)
+	if err != nil {
+		return "", err
+	}
+	v += fmt.Sprintf("+git%s.%d.%s", commit.Committer.When.UTC().Format("20060102"), count, hash)
+	if dirty {
+		v += ".dirty"
+	}
+	return v, nil
+}
+
+// branchCommit returns the commit of Branch, which may be a branch, tag or
+// commit.
+func (pkg *Package) branchCommit(repo *git.Repository) (*git.Commit, error) {
+	out, err := git.NewCommand("rev-parse", "--verify", pkg.Branch+"^{commit}").RunInDir(pkg.Repo)
+	if err != nil {
+		return nil, fmt.Errorf("can't resolve %s at %s: %v", pkg.Branch, pkg.Repo, err)
+	}
+	commit, err := repo.GetCommit(strings.TrimSpace(out))
+	if err != nil {
+		return nil, fmt.Errorf("can't get commit of %s at %s: %v", pkg.Branch, pkg.Repo, err)
+	}
+	return commit, nil
+}
+
+// gitDirty reports if the work tree of the repository has uncommitted changes,
+// and Branch is checked out in it. Bare repositories and checkout builds are
+// never dirty.
+func (pkg *Package) gitDirty() (bool, error) {
+	if pkg.Checkout {
+		return false, nil
+	}
+	out, err := git.NewCommand("rev-parse", "--is-bare-repository").RunInDir(pkg.Repo)
+	if err != nil {
+		return false, fmt.Errorf("can't get git repository at %s: %v", pkg.Repo, err)
+	}
+	if strings.TrimSpace(out) == "true" {
+		return false, nil
+	}
+
+	head, err := git.NewCommand("rev-parse", "--verify", "HEAD").RunInDir(pkg.Repo)
+	if err != nil {
+		return false, fmt.Errorf("can't resolve HEAD at %s: %v", pkg.Repo, err)
+	}
+	branch, err := git.NewCommand("rev-parse", "--verify", pkg.Branch+"^{commit}").RunInDir(pkg.Repo)
+	if err != nil {
+		return false, fmt.Errorf("can't resolve %s at %s: %v", pkg.Branch, pkg.Repo, err)
+	}
+	if strings.TrimSpace(head) != strings.TrimSpace(branch) {
+		return false, nil
+	}
+
+	if out, err = git.NewCommand("status", "--porcelain", "--untracked-files=no").RunInDir(pkg.Repo); err != nil {
+		return false, fmt.Errorf("can't get git status at %s: %v", pkg.Repo, err)
+	}
+	return strings.TrimSpace(out) != "", nil
 }
 
 func (pkg *Package) gitVersion() (string, error) {
@@ -295,9 +822,9 @@ func (pkg *Package) gitVersion() (string, error) {
 		return "", fmt.Errorf("can't get git repository at %s: %v", pkg.Repo, err)
 	}
 
-	commit, err := repo.GetBranchCommit(pkg.Branch)
+	commit, err := pkg.branchCommit(repo)
 	if err != nil {
-		return "", fmt.Errorf("can't get branch %s at %s: %v", pkg.Branch, pkg.Repo, err)
+		return "", err
 	}
 
 	count, err := commit.CommitsCount()
@@ -308,20 +835,19 @@ func (pkg *Package) gitVersion() (string, error) {
 	return fmt.Sprintf("%d", count), nil
 }
 
-func command(run string) (string, []string) {
-	var fields = strings.Fields(run)
-	if len(fields) > 1 {
-		return fields[0], fields[1:]
-	}
-	return fields[0], []string{}
-}
-
 type PackageMeta struct {
 	Meta
-	Summary     string
-	Description string
-	DebConflict []string `json:"deb-conflict"`
-	DebRequires []string `json:"deb-requires"`
-	RPMConflict []string `json:"rpm-conflict"`
-	RPMRequires []string `json:"rpm-requires"`
+	Summary       string
+	Description   string
+	DebConflict   []string `json:"deb-conflict"`
+	DebRequires   []string `json:"deb-requires"`
+	DebPreDepends []string `json:"deb-pre-depends"`
+	DebRecommends []string `json:"deb-recommends"`
+	DebSuggests   []string `json:"deb-suggests"`
+	DebEnhances   []string `json:"deb-enhances"`
+	DebBreaks     []string `json:"deb-breaks"`
+	DebReplaces   []string `json:"deb-replaces"`
+	DebProvides   []string `json:"deb-provides"`
+	RPMConflict   []string `json:"rpm-conflict"`
+	RPMRequires   []string `json:"rpm-requires"`
 }
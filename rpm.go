@@ -2,22 +2,33 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	rpmMagic        = [4]byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic  = [8]byte{0x8e, 0xad, 0xe8, 0x01, 0x00, 0x00, 0x00, 0x00}
 	defaultRPMGroup = "Applications/Internet"
 
-	// See rpmrc.in
-	rpmArch = map[string]uint16{
-		"386":   1,
-		"amd64": 1,
-		"arm":   12,
-	}
+	defaultRPMRelease = "1"
+
+	// Build host recorded in reproducible builds.
+	reproducibleBuildHost = "reproducible"
 
 	// See rpmrc.in
 	rpmOS = map[string]uint16{
@@ -30,11 +41,140 @@ var (
 const (
 	binaryRPM = 0x0000
 	sourceRPM = 0x0001
+
+	// RPMSIGTYPE_HEADERSIG, the only signature type in use since rpm 3
+	rpmSignatureType = 5
+)
+
+// Header data types, see rpmtag.h
+const (
+	rpmNull        = 0
+	rpmChar        = 1
+	rpmInt8        = 2
+	rpmInt16       = 3
+	rpmInt32       = 4
+	rpmInt64       = 5
+	rpmString      = 6
+	rpmBin         = 7
+	rpmStringArray = 8
+	rpmI18NString  = 9
+)
+
+// Header tags, see rpmtag.h
+const (
+	rpmTagHeaderSignatures = 62
+	rpmTagHeaderImmutable  = 63
+	rpmTagHeaderI18NTable  = 100
+
+	rpmSigTagSHA1            = 269
+	rpmSigTagLongSize        = 270
+	rpmSigTagLongArchiveSize = 271
+	rpmSigTagSHA256          = 273
+	rpmSigTagSize            = 1000
+	rpmSigTagMD5             = 1004
+	rpmSigTagPayloadSize     = 1007
+
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagEpoch             = 1003
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagVendor            = 1011
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagPreIn             = 1023
+	rpmTagPostIn            = 1024
+	rpmTagPreUn             = 1025
+	rpmTagPostUn            = 1026
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRDevs         = 1033
+	rpmTagFileMTimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagConflictFlags     = 1053
+	rpmTagConflictName      = 1054
+	rpmTagConflictVersion   = 1055
+	rpmTagRPMVersion        = 1064
+	rpmTagFileDevices       = 1095
+	rpmTagFileInodes        = 1096
+	rpmTagPreInProg         = 1085
+	rpmTagPostInProg        = 1086
+	rpmTagPreUnProg         = 1087
+	rpmTagPostUnProg        = 1088
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagLongSize          = 5009
+	rpmTagFileDigestAlgo    = 5011
+)
+
+// Dependency flags, see rpmds.h
+const (
+	rpmSenseLess    = 0x02
+	rpmSenseGreater = 0x04
+	rpmSenseEqual   = 0x08
+	rpmSenseRPMLib  = 1 << 24
+)
+
+// File flags, see rpmfiles.h
+const (
+	rpmFileConfig    = 1 << 0
+	rpmFileNoReplace = 1 << 4
 )
 
+// PGPHASHALGO_SHA256, used for FILEDIGESTS
+const rpmDigestSHA256 = 8
+
+// Scriptlet and interpreter tags for each maintainer script phase.
+var rpmScriptTags = map[string][2]int32{
+	"preinst":  {rpmTagPreIn, rpmTagPreInProg},
+	"postinst": {rpmTagPostIn, rpmTagPostInProg},
+	"prerm":    {rpmTagPreUn, rpmTagPreUnProg},
+	"postrm":   {rpmTagPostUn, rpmTagPostUnProg},
+}
+
+// rpmlib features the generated packages depend on.
+var rpmLibRequires = []string{
+	"rpmlib(CompressedFileNames) <= 3.0.4-1",
+	"rpmlib(FileDigests) <= 4.6.0-1",
+	"rpmlib(PayloadFilesHavePrefix) <= 4.0-1",
+}
+
+// rpmlib features required by versions containing a character, the versions
+// sort incorrectly in older rpm.
+var rpmLibVersionRequires = []struct {
+	char    string
+	feature string
+}{
+	{"~", "rpmlib(TildeInVersions) <= 4.10.0-1"},
+	{"^", "rpmlib(CaretInVersions) <= 4.15.0-1"},
+}
+
 type RPM struct {
 	Package     string
+	Epoch       int
 	Version     string
+	Release     string
 	Group       string
 	Arch        string
 	Conflicts   []string
@@ -43,42 +183,77 @@ type RPM struct {
 	Vendor      string
 	Summary     string
 	Description string
-	tree        tree
-	header      *RPMHeader
+	Scripts     map[string]string
+
+	// Compression of the payload, see compressions.
+	Compression      string
+	CompressionLevel int
+
+	tree       tree
+	header     *RPMHeader
+	sourceDate time.Time
 }
 
-func NewRPM(name, version string) (*RPM, error) {
+func NewRPM(name, version, goarch string) (*RPM, error) {
 	r := &RPM{
 		Package:   name,
 		Version:   version,
+		Release:   defaultRPMRelease,
 		Conflicts: make([]string, 0),
 		Requires:  make([]string, 0),
 		Group:     defaultRPMGroup,
 		tree:      make(tree),
 	}
+	r.Compression, r.CompressionLevel, _ = parseCompression(defaultCompression, 0)
 
-	switch runtime.GOARCH {
-	case "386":
-		r.Arch = "i386"
-	case "amd64":
-		r.Arch = "x86_64"
-	default:
-		return nil, fmt.Errorf("rpm: unsupported architecture %q", runtime.GOARCH)
+	a, ok := architectures[goarch]
+	if !ok {
+		return nil, fmt.Errorf("rpm: unsupported architecture %q", goarch)
 	}
+	r.Arch = a.RPM
 
 	var err error
-	if r.header, err = newRPMHeader(r.Name(), runtime.GOARCH, runtime.GOOS); err != nil {
+	if r.header, err = newRPMHeader(r.nvr(), a.RPMLead, runtime.GOOS); err != nil {
 		return nil, err
 	}
 	return r, nil
 }
 
-func (r *RPM) Add(name string, mode os.FileMode, data []byte) {
-	r.tree[name] = leaf{name: name, mode: mode, data: data}
+func (r *RPM) Add(l leaf) {
+	r.tree[l.name] = l
+}
+
+func (r *RPM) AddScripts(s Scripts) {
+	r.Scripts = s.rpm()
+}
+
+// SetCompression selects the payload compression. RPM requires a compressed
+// payload, without compression a stored gzip stream is used.
+func (r *RPM) SetCompression(name string, level int) error {
+	if name == "none" {
+		r.Compression, r.CompressionLevel = "gzip", gzip.NoCompression
+		return nil
+	}
+	var err error
+	r.Compression, r.CompressionLevel, err = parseCompression(name, level)
+	return err
+}
+
+// SetSourceDate makes the build reproducible, using t for all timestamps.
+func (r *RPM) SetSourceDate(t time.Time) {
+	r.sourceDate = t
 }
 
 func (r *RPM) Name() string {
-	return fmt.Sprintf("%s-%s.%s.rpm", r.Package, r.Version, r.Arch)
+	return fmt.Sprintf("%s.%s.rpm", r.nvr(), r.Arch)
+}
+
+func (r *RPM) NameData() templateData {
+	return templateData{Name: r.Package, Version: r.Version, Release: r.Release, Arch: r.Arch}
+}
+
+func (r *RPM) nvr() string {
+	return fmt.Sprintf("%s-%s-%s", r.Package, r.Version, r.Release)
 }
 
 func (r *RPM) ParseMeta(meta PackageMeta) error {
@@ -86,17 +261,318 @@ func (r *RPM) ParseMeta(meta PackageMeta) error {
 	r.URL = meta.Homepage
 	r.Summary = meta.Summary
 	r.Description = meta.Description
+	r.Requires = meta.RPMRequires
+	r.Conflicts = meta.RPMConflict
 	return nil
 }
 
 func (r *RPM) WriteTo(w io.Writer) error {
-	if err := r.header.WriteTo(w); err != nil {
+	var (
+		now   = time.Now()
+		leafs = r.tree.sorted()
+	)
+	if !r.sourceDate.IsZero() {
+		now = r.sourceDate
+	}
+
+	// File digests are collected in a first pass, the header precedes the
+	// payload and is covered by the same MD5 digest.
+	header, err := r.createHeader(now, leafs)
+	if err != nil {
+		return err
+	}
+
+	// The payload is spooled to a temporary file, as the signature needs its
+	// size and digest.
+	payload, err := ioutil.TempFile("", "ship-payload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(payload.Name())
+	defer payload.Close()
+
+	md5sum := md5.New()
+	md5sum.Write(header)
+	payloadSize, err := r.createPayload(now, leafs, io.MultiWriter(payload, md5sum))
+	if err != nil {
+		return err
+	}
+	compressedSize, err := payload.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	signature := r.createSignature(header, md5sum.Sum(nil), compressedSize, payloadSize)
+
+	// The release may have changed since the lead was created.
+	lead, err := newRPMHeader(r.nvr(), r.header.Arch, runtime.GOOS)
+	if err != nil {
+		return err
+	}
+	if err := lead.WriteTo(w); err != nil {
+		return fmt.Errorf("rpm: error writing lead: %v", err)
+	}
+	if _, err := w.Write(signature); err != nil {
+		return fmt.Errorf("rpm: error writing signature: %v", err)
+	}
+	if _, err := w.Write(header); err != nil {
 		return fmt.Errorf("rpm: error writing header: %v", err)
 	}
+	if _, err := payload.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("rpm: error writing payload: %v", err)
+	}
+	if _, err := io.Copy(w, payload); err != nil {
+		return fmt.Errorf("rpm: error writing payload: %v", err)
+	}
 
 	return nil
 }
 
+// createPayload writes the compressed cpio archive to w and returns its
+// uncompressed size.
+func (r *RPM) createPayload(now time.Time, leafs leafs, w io.Writer) (int64, error) {
+	zip, err := newCompressor(w, r.Compression, r.CompressionLevel)
+	if err != nil {
+		return 0, err
+	}
+	out := newCpioWriter(zip)
+
+	for i, leaf := range leafs {
+		header := cpioHeader{
+			Inode:   i + 1,
+			Mode:    unixMode(leaf.mode),
+			UID:     leaf.uid,
+			GID:     leaf.gid,
+			Links:   1,
+			ModTime: leaf.modTime(now),
+			Size:    leaf.size(),
+			Name:    "." + leaf.name,
+		}
+		if leaf.mode.IsDir() {
+			header.Links = 2
+		}
+		if err := out.WriteHeader(&header); err != nil {
+			return 0, fmt.Errorf("rpm: can't write header of %s to payload: %v", leaf.name, err)
+		}
+		switch {
+		case leaf.mode.IsDir():
+		case leaf.mode&os.ModeSymlink != 0:
+			_, err = out.Write([]byte(leaf.link))
+		default:
+			_, err = leaf.copyTo(out)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("rpm: can't write data of %s to payload: %v", leaf.name, err)
+		}
+		if err := out.Flush(); err != nil {
+			return 0, fmt.Errorf("rpm: can't write data of %s to payload: %v", leaf.name, err)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("rpm: can't close payload: %v", err)
+	}
+	if err := zip.Close(); err != nil {
+		return 0, fmt.Errorf("rpm: can't close payload compressor: %v", err)
+	}
+
+	return out.Len(), nil
+}
+
+func (r *RPM) createHeader(now time.Time, leafs leafs) ([]byte, error) {
+	var (
+		h    = make(rpmIndex)
+		size int64
+		host string
+		err  error
+	)
+
+	if !r.sourceDate.IsZero() {
+		host = reproducibleBuildHost
+	} else if host, err = os.Hostname(); err != nil {
+		return nil, err
+	}
+
+	h.AddStringArray(rpmTagHeaderI18NTable, "C")
+	h.AddString(rpmTagName, r.Package)
+	h.AddString(rpmTagVersion, r.Version)
+	h.AddString(rpmTagRelease, r.Release)
+	if r.Epoch > 0 {
+		h.AddInt32(rpmTagEpoch, int32(r.Epoch))
+	}
+	h.AddI18NString(rpmTagSummary, r.Summary)
+	h.AddI18NString(rpmTagDescription, r.Description)
+	h.AddInt32(rpmTagBuildTime, int32(now.Unix()))
+	h.AddString(rpmTagBuildHost, host)
+	h.AddI18NString(rpmTagGroup, r.Group)
+	if r.Vendor != "" {
+		h.AddString(rpmTagVendor, r.Vendor)
+	}
+	if r.URL != "" {
+		h.AddString(rpmTagURL, r.URL)
+	}
+	h.AddString(rpmTagOS, "linux")
+	h.AddString(rpmTagArch, r.Arch)
+	h.AddString(rpmTagRPMVersion, "4.4.2")
+	h.AddString(rpmTagPayloadFormat, "cpio")
+	h.AddString(rpmTagPayloadCompressor, compressions[r.Compression].RPM)
+	h.AddString(rpmTagPayloadFlags, strconv.Itoa(r.CompressionLevel))
+
+	if len(leafs) > 0 {
+		var (
+			n         = len(leafs)
+			sizes     = make([]int32, n)
+			modes     = make([]int16, n)
+			rdevs     = make([]int16, n)
+			mtimes    = make([]int32, n)
+			digests   = make([]string, n)
+			linktos   = make([]string, n)
+			flags     = make([]int32, n)
+			usernames = make([]string, n)
+			groups    = make([]string, n)
+			devices   = make([]int32, n)
+			inodes    = make([]int32, n)
+			langs     = make([]string, n)
+			dirindex  = make([]int32, n)
+			basenames = make([]string, n)
+			dirnames  = make([]string, 0)
+			dirs      = make(map[string]int32)
+			digest    = sha256.New()
+		)
+		for i, leaf := range leafs {
+			dir, base := path.Split(leaf.name)
+			if _, ok := dirs[dir]; !ok {
+				dirs[dir] = int32(len(dirnames))
+				dirnames = append(dirnames, dir)
+			}
+			sizes[i] = int32(leaf.size())
+			modes[i] = int16(unixMode(leaf.mode))
+			mtimes[i] = int32(leaf.modTime(now).Unix())
+			if leaf.size() > math.MaxUint32 {
+				return nil, fmt.Errorf("rpm: %s is larger than 4 GiB", leaf.name)
+			}
+			if leaf.mode.IsRegular() {
+				sum, err := leaf.Checksum(digest)
+				if err != nil {
+					return nil, fmt.Errorf("rpm: can't compute digest of %s: %v", leaf.name, err)
+				}
+				digests[i] = fmt.Sprintf("%x", sum)
+			}
+			linktos[i] = leaf.link
+			if leaf.config {
+				flags[i] = rpmFileConfig
+				if leaf.noreplace {
+					flags[i] |= rpmFileNoReplace
+				}
+			}
+			usernames[i] = leaf.owner
+			groups[i] = leaf.group
+			devices[i] = 1
+			inodes[i] = int32(i + 1)
+			dirindex[i] = dirs[dir]
+			basenames[i] = base
+			size += leaf.size()
+		}
+		h.AddInt32(rpmTagFileSizes, sizes...)
+		h.AddInt16(rpmTagFileModes, modes...)
+		h.AddInt16(rpmTagFileRDevs, rdevs...)
+		h.AddInt32(rpmTagFileMTimes, mtimes...)
+		h.AddStringArray(rpmTagFileDigests, digests...)
+		h.AddStringArray(rpmTagFileLinkTos, linktos...)
+		h.AddInt32(rpmTagFileFlags, flags...)
+		h.AddStringArray(rpmTagFileUserName, usernames...)
+		h.AddStringArray(rpmTagFileGroupName, groups...)
+		h.AddInt32(rpmTagFileDevices, devices...)
+		h.AddInt32(rpmTagFileInodes, inodes...)
+		h.AddStringArray(rpmTagFileLangs, langs...)
+		h.AddInt32(rpmTagDirIndexes, dirindex...)
+		h.AddStringArray(rpmTagBaseNames, basenames...)
+		h.AddStringArray(rpmTagDirNames, dirnames...)
+		h.AddInt32(rpmTagFileDigestAlgo, rpmDigestSHA256)
+	}
+	h.AddSize(rpmTagSize, rpmTagLongSize, size)
+
+	for phase, script := range r.Scripts {
+		tags := rpmScriptTags[phase]
+		h.AddString(tags[0], script)
+		// Like rpmbuild -p, the interpreter and its arguments are an array.
+		h.AddStringArray(tags[1], scriptInterpreter(script)...)
+	}
+
+	var evr = rpmEVR(r.Epoch, r.Version, r.Release)
+	if err = h.AddDependencies(rpmTagProvideName, rpmTagProvideFlags, rpmTagProvideVersion,
+		[]string{r.Package + " = " + evr}, 0); err != nil {
+		return nil, err
+	}
+	var rpmlib = rpmLibRequires[:len(rpmLibRequires):len(rpmLibRequires)]
+	if feature := compressions[r.Compression].RPMLib; feature != "" {
+		rpmlib = append(rpmlib, feature)
+	}
+	var versions = strings.Join(append(append([]string{evr}, r.Requires...), r.Conflicts...), " ")
+	for _, v := range rpmLibVersionRequires {
+		if strings.Contains(versions, v.char) {
+			rpmlib = append(rpmlib, v.feature)
+		}
+	}
+	if err = h.AddDependencies(rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion,
+		rpmlib, rpmSenseRPMLib); err != nil {
+		return nil, err
+	}
+	if err = h.AddDependencies(rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion,
+		r.Requires, 0); err != nil {
+		return nil, err
+	}
+	if err = h.AddDependencies(rpmTagConflictName, rpmTagConflictFlags, rpmTagConflictVersion,
+		r.Conflicts, 0); err != nil {
+		return nil, err
+	}
+
+	return h.Bytes(rpmTagHeaderImmutable, 0), nil
+}
+
+// createSignature returns the signature header over the main header and the
+// payload, padded to an 8 byte boundary. The MD5 digest covers the header and
+// the compressed payload.
+func (r *RPM) createSignature(header, md5sum []byte, compressedSize, payloadSize int64) []byte {
+	var h = make(rpmIndex)
+
+	h.AddString(rpmSigTagSHA1, fmt.Sprintf("%x", sha1.Sum(header)))
+	h.AddString(rpmSigTagSHA256, fmt.Sprintf("%x", sha256.Sum256(header)))
+	h.AddSize(rpmSigTagSize, rpmSigTagLongSize, int64(len(header))+compressedSize)
+	h.AddBinary(rpmSigTagMD5, md5sum)
+	h.AddSize(rpmSigTagPayloadSize, rpmSigTagLongArchiveSize, payloadSize)
+
+	return h.Bytes(rpmTagHeaderSignatures, 8)
+}
+
+// parseRPMDependency splits a dependency like "foo >= 1.0" into its name,
+// sense flags and version.
+func parseRPMDependency(dep string) (string, int32, string, error) {
+	var fields = strings.Fields(dep)
+	switch len(fields) {
+	case 1:
+		return fields[0], 0, "", nil
+	case 3:
+		var flags int32
+		switch fields[1] {
+		case "<":
+			flags = rpmSenseLess
+		case "<=":
+			flags = rpmSenseLess | rpmSenseEqual
+		case "=", "==":
+			flags = rpmSenseEqual
+		case ">=":
+			flags = rpmSenseGreater | rpmSenseEqual
+		case ">":
+			flags = rpmSenseGreater
+		default:
+			return "", 0, "", fmt.Errorf("rpm: invalid operator in dependency %q", dep)
+		}
+		return fields[0], flags, fields[2], nil
+	default:
+		return "", 0, "", fmt.Errorf("rpm: invalid dependency %q", dep)
+	}
+}
+
 type RPMHeader struct {
 	Magic         [4]byte
 	Major, Minor  byte
@@ -108,20 +584,19 @@ type RPMHeader struct {
 	Reserved      [16]byte
 }
 
-func newRPMHeader(name, arch, os string) (*RPMHeader, error) {
+func newRPMHeader(name string, arch uint16, os string) (*RPMHeader, error) {
 	h := &RPMHeader{
-		Major: 3,
-		Minor: 0,
-		Type:  binaryRPM,
+		Major:         3,
+		Minor:         0,
+		Type:          binaryRPM,
+		Arch:          arch,
+		SignatureType: rpmSignatureType,
 	}
 
 	copy(h.Magic[:], rpmMagic[:])
 	copy(h.Name[:65], []byte(name))
 
 	var ok bool
-	if h.Arch, ok = rpmArch[arch]; !ok {
-		return nil, fmt.Errorf("rpm: unsupported architecture %s", arch)
-	}
 	if h.OS, ok = rpmOS[os]; !ok {
 		return nil, fmt.Errorf("rpm: unsupported operating system %s", os)
 	}
@@ -143,4 +618,144 @@ func (h *RPMHeader) WriteTo(w io.Writer) error {
 	return err
 }
 
+type rpmEntry struct {
+	typ   int32
+	count int32
+	data  []byte
+}
+
+// rpmIndex collects the entries of an RPM header structure, keyed by tag.
+type rpmIndex map[int32]*rpmEntry
+
+func (h rpmIndex) add(tag, typ int32, count int, data []byte) {
+	if e, ok := h[tag]; ok && e.typ == typ && typ != rpmString && typ != rpmBin {
+		e.count += int32(count)
+		e.data = append(e.data, data...)
+		return
+	}
+	h[tag] = &rpmEntry{typ: typ, count: int32(count), data: data}
+}
+
+func (h rpmIndex) AddString(tag int32, s string) {
+	h.add(tag, rpmString, 1, append([]byte(s), 0))
+}
+
+func (h rpmIndex) AddI18NString(tag int32, s string) {
+	h.add(tag, rpmI18NString, 1, append([]byte(s), 0))
+}
+
+func (h rpmIndex) AddStringArray(tag int32, s ...string) {
+	var buf = new(bytes.Buffer)
+	for _, v := range s {
+		buf.WriteString(v)
+		buf.WriteByte(0)
+	}
+	h.add(tag, rpmStringArray, len(s), buf.Bytes())
+}
+
+func (h rpmIndex) AddInt16(tag int32, v ...int16) {
+	var buf = new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, v)
+	h.add(tag, rpmInt16, len(v), buf.Bytes())
+}
+
+func (h rpmIndex) AddInt32(tag int32, v ...int32) {
+	var buf = new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, v)
+	h.add(tag, rpmInt32, len(v), buf.Bytes())
+}
+
+func (h rpmIndex) AddInt64(tag int32, v ...int64) {
+	var buf = new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, v)
+	h.add(tag, rpmInt64, len(v), buf.Bytes())
+}
+
+// AddSize adds size to the 32 bit tag, or to the 64 bit tag if it doesn't fit,
+// like rpmbuild.
+func (h rpmIndex) AddSize(tag, longTag int32, size int64) {
+	if size > math.MaxUint32 {
+		h.AddInt64(longTag, size)
+		return
+	}
+	h.AddInt32(tag, int32(uint32(size)))
+}
+
+func (h rpmIndex) AddBinary(tag int32, b []byte) {
+	h.add(tag, rpmBin, len(b), b)
+}
+
+// AddDependencies adds a list of dependencies to the name, flags and version
+// tags of a dependency set.
+func (h rpmIndex) AddDependencies(nameTag, flagsTag, versionTag int32, deps []string, sense int32) error {
+	for _, dep := range deps {
+		name, flags, version, err := parseRPMDependency(dep)
+		if err != nil {
+			return err
+		}
+		h.AddStringArray(nameTag, name)
+		h.AddInt32(flagsTag, flags|sense)
+		h.AddStringArray(versionTag, version)
+	}
+	return nil
+}
+
+func rpmAlignment(typ int32) int {
+	switch typ {
+	case rpmInt16:
+		return 2
+	case rpmInt32:
+		return 4
+	case rpmInt64:
+		return 8
+	default:
+		return 1
+	}
+}
+
+// Bytes encodes the header structure with an immutable region covering all
+// entries. If pad is non-zero, the result is padded to a multiple of pad.
+func (h rpmIndex) Bytes(region int32, pad int) []byte {
+	var (
+		tags  = make([]int, 0, len(h))
+		index = new(bytes.Buffer)
+		store = new(bytes.Buffer)
+		entry = func(w io.Writer, tag, typ, offset, count int32) {
+			binary.Write(w, binary.BigEndian, []int32{tag, typ, offset, count})
+		}
+	)
+	for tag := range h {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+
+	for _, tag := range tags {
+		e := h[int32(tag)]
+		if align := rpmAlignment(e.typ); store.Len()%align != 0 {
+			store.Write(make([]byte, align-store.Len()%align))
+		}
+		entry(index, int32(tag), e.typ, int32(store.Len()), e.count)
+		store.Write(e.data)
+	}
+
+	// The region trailer is an index entry pointing back to the start of the
+	// index, stored at the end of the data.
+	var (
+		offset = int32(store.Len())
+		count  = int32(len(tags) + 1)
+	)
+	entry(store, region, rpmBin, -count*16, 16)
+
+	buf := new(bytes.Buffer)
+	buf.Write(rpmHeaderMagic[:])
+	binary.Write(buf, binary.BigEndian, []int32{count, int32(store.Len())})
+	entry(buf, region, rpmBin, offset, 16)
+	buf.Write(index.Bytes())
+	buf.Write(store.Bytes())
+	if pad > 0 && buf.Len()%pad != 0 {
+		buf.Write(make([]byte, pad-buf.Len()%pad))
+	}
+	return buf.Bytes()
+}
+
 var _ Archive = (*RPM)(nil)
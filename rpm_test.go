@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readRPMIndex decodes a header structure at the start of b, and returns its
+// entries and length. Values are strings, string slices, int32 or int64
+// slices, or bytes.
+func readRPMIndex(t *testing.T, b []byte) (map[int32]interface{}, int) {
+	t.Helper()
+	if len(b) < 16 || !bytes.Equal(b[:8], rpmHeaderMagic[:]) {
+		t.Fatal("missing header magic")
+	}
+	var (
+		count   = int(binary.BigEndian.Uint32(b[8:]))
+		size    = int(binary.BigEndian.Uint32(b[12:]))
+		store   = b[16+count*16 : 16+count*16+size]
+		entries = make(map[int32]interface{})
+	)
+	for i := 0; i < count; i++ {
+		var e [4]int32
+		binary.Read(bytes.NewReader(b[16+i*16:]), binary.BigEndian, &e)
+		tag, typ, offset, n := e[0], e[1], int(e[2]), int(e[3])
+		if i == 0 && tag != rpmTagHeaderSignatures && tag != rpmTagHeaderImmutable {
+			t.Fatalf("first entry is %d, not a region", tag)
+		}
+		switch typ {
+		case rpmString, rpmI18NString:
+			entries[tag] = string(store[offset : offset+bytes.IndexByte(store[offset:], 0)])
+		case rpmStringArray:
+			entries[tag] = strings.SplitN(string(store[offset:]), "\x00", n+1)[:n]
+		case rpmInt32:
+			var v = make([]int32, n)
+			binary.Read(bytes.NewReader(store[offset:]), binary.BigEndian, v)
+			entries[tag] = v
+		case rpmInt64:
+			var v = make([]int64, n)
+			binary.Read(bytes.NewReader(store[offset:]), binary.BigEndian, v)
+			entries[tag] = v
+		default:
+			entries[tag] = store[offset : offset+n]
+		}
+	}
+	return entries, 16 + count*16 + size
+}
+
+// readCpio returns the names and contents of the entries of a newc archive.
+func readCpio(t *testing.T, b []byte) ([]string, map[string]string) {
+	t.Helper()
+	var (
+		names []string
+		data  = make(map[string]string)
+		pad   = func(n int) int { return (n + 3) &^ 3 }
+	)
+	for p := 0; ; {
+		if string(b[p:p+6]) != "070701" {
+			t.Fatalf("bad cpio magic at %d", p)
+		}
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(b[p+6+i*8:p+14+i*8]), 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return int(v)
+		}
+		var (
+			size     = field(6)
+			nameSize = field(11)
+			name     = string(b[p+110 : p+110+nameSize-1])
+		)
+		if name == "TRAILER!!!" {
+			return names, data
+		}
+		p = pad(p + 110 + nameSize)
+		names = append(names, name)
+		data[name] = string(b[p : p+size])
+		p = pad(p + size)
+	}
+}
+
+func TestRPMWriteTo(t *testing.T) {
+	var file = filepath.Join(t.TempDir(), "hello")
+	if err := os.WriteFile(file, []byte("hi\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRPM("demo", "1.0~rc1", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ParseMeta(PackageMeta{Summary: "Demo", RPMRequires: []string{"bash >= 4.0"}})
+	r.SetSourceDate(time.Unix(1700000000, 0))
+	r.Add(leaf{name: "/usr/bin", mode: os.ModeDir | 0755, owner: "root", group: "root"})
+	r.Add(leaf{name: "/usr/bin/hello", mode: 0755, owner: "root", group: "root", src: file, filesize: 3})
+
+	var buf = new(bytes.Buffer)
+	if err = r.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	var b = buf.Bytes()
+
+	if !bytes.Equal(b[:4], rpmMagic[:]) {
+		t.Fatal("missing lead magic")
+	}
+	if name := string(bytes.TrimRight(b[10:76], "\x00")); name != "demo-1.0~rc1-1" {
+		t.Errorf("lead name %q", name)
+	}
+
+	sig, n := readRPMIndex(t, b[96:])
+	n = (n + 7) &^ 7
+	header, headerSize := readRPMIndex(t, b[96+n:])
+	var (
+		headerBytes = b[96+n : 96+n+headerSize]
+		payload     = b[96+n+headerSize:]
+	)
+
+	if got := sig[rpmSigTagSize].([]int32)[0]; int(got) != len(headerBytes)+len(payload) {
+		t.Errorf("signature size %d, want %d", got, len(headerBytes)+len(payload))
+	}
+	if sum := md5.Sum(b[96+n:]); !bytes.Equal(sig[rpmSigTagMD5].([]byte), sum[:]) {
+		t.Error("signature MD5 doesn't match")
+	}
+	if got, want := sig[rpmSigTagSHA256], fmt.Sprintf("%x", sha256.Sum256(headerBytes)); got != want {
+		t.Errorf("signature SHA256 %s, want %s", got, want)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpio, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sig[rpmSigTagPayloadSize].([]int32)[0]; int(got) != len(cpio) {
+		t.Errorf("payload size %d, want %d", got, len(cpio))
+	}
+
+	for tag, want := range map[int32]interface{}{
+		rpmTagName:        "demo",
+		rpmTagVersion:     "1.0~rc1",
+		rpmTagRelease:     "1",
+		rpmTagBaseNames:   []string{"bin", "hello"},
+		rpmTagDirNames:    []string{"/usr/", "/usr/bin/"},
+		rpmTagDirIndexes:  []int32{0, 1},
+		rpmTagFileSizes:   []int32{0, 3},
+		rpmTagRequireName: []string{"rpmlib(CompressedFileNames)", "rpmlib(FileDigests)", "rpmlib(PayloadFilesHavePrefix)", "rpmlib(TildeInVersions)", "bash"},
+	} {
+		if got := header[tag]; !reflect.DeepEqual(got, want) {
+			t.Errorf("tag %d is %q, want %q", tag, got, want)
+		}
+	}
+
+	names, data := readCpio(t, cpio)
+	if want := []string{"./usr/bin", "./usr/bin/hello"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("payload has %q, want %q", names, want)
+	}
+	if data["./usr/bin/hello"] != "hi\n" {
+		t.Errorf("payload has %q for hello", data["./usr/bin/hello"])
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// jsonSchema is a JSON Schema (draft-07) node.
+type jsonSchema map[string]interface{}
+
+// schemaEnums are the allowed values of fields, by type and field name.
+var schemaEnums = map[string]func() []string{
+	"Package.Formats": func() []string {
+		var names = make([]string, 0, len(supportedFormats))
+		for name := range supportedFormats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	},
+	"Package.Compression": func() []string {
+		var names = make([]string, 0, len(compressions))
+		for name := range compressions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	},
+	"Target.Type": func() []string {
+		return []string{typeFile, typeDir, typeSymlink}
+	},
+}
+
+// schemaBuilder generates the schema of the config structures. Named structs
+// are added to the definitions, and referenced.
+type schemaBuilder struct {
+	definitions map[string]jsonSchema
+}
+
+// configSchema returns the schema of the config.
+func configSchema() jsonSchema {
+	var (
+		s      = &schemaBuilder{definitions: make(map[string]jsonSchema)}
+		schema = s.object(reflect.TypeOf(Config{}))
+	)
+	// Extension keys, see Config.
+	schema["patternProperties"] = jsonSchema{"^x-": jsonSchema{}}
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "ship config"
+	schema["definitions"] = s.definitions
+	return schema
+}
+
+func (s *schemaBuilder) ref(name string, define func() jsonSchema) jsonSchema {
+	if _, ok := s.definitions[name]; !ok {
+		// Reserve the name first, for recursive types.
+		s.definitions[name] = nil
+		s.definitions[name] = define()
+	}
+	return jsonSchema{"$ref": "#/definitions/" + name}
+}
+
+func (s *schemaBuilder) schema(t reflect.Type) jsonSchema {
+	switch t {
+	case manifestType:
+		return s.ref("Manifest", s.manifest)
+	case generateStepType:
+		return s.ref("GenerateStep", s.generateStep)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return s.ref(t.Name(), func() jsonSchema { return s.object(t) })
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Slice:
+		return jsonSchema{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int:
+		return jsonSchema{"type": "integer"}
+	}
+	panic(fmt.Sprintf("schema: unsupported type %s", t))
+}
+
+// object returns the schema of a struct. Keys are matched case insensitive by
+// the decoder, the schema uses the json tag or the lowercase field name.
+func (s *schemaBuilder) object(t reflect.Type) jsonSchema {
+	var properties = make(map[string]jsonSchema)
+	s.fields(t, properties)
+	return jsonSchema{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+func (s *schemaBuilder) fields(t reflect.Type, properties map[string]jsonSchema) {
+	for i := 0; i < t.NumField(); i++ {
+		var f = t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			s.fields(f.Type, properties)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		var name = strings.ToLower(f.Name)
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		var schema = s.schema(f.Type)
+		if enum, ok := schemaEnums[t.Name()+"."+f.Name]; ok {
+			if f.Type.Kind() == reflect.Slice {
+				schema["items"] = jsonSchema{"type": "string", "enum": enum()}
+			} else {
+				schema["enum"] = enum()
+			}
+		}
+		properties[name] = schema
+	}
+}
+
+// manifest describes the object and list forms of Manifest.
+func (s *schemaBuilder) manifest() jsonSchema {
+	var entry = s.object(reflect.TypeOf(manifestListEntry{}))
+	entry["required"] = []string{"src"}
+	return jsonSchema{
+		"oneOf": []jsonSchema{
+			{
+				"description": "Targets keyed by source pattern, a target is a destination or an object.",
+				"type":        "object",
+				"additionalProperties": jsonSchema{
+					"oneOf": []jsonSchema{
+						{"type": "string"},
+						s.schema(reflect.TypeOf(Target{})),
+					},
+				},
+			},
+			{
+				"description": "Entries with a source pattern and destination, processed in order.",
+				"type":        "array",
+				"items":       entry,
+			},
+		},
+	}
+}
+
+// generateStep describes the forms of GenerateStep.
+func (s *schemaBuilder) generateStep() jsonSchema {
+	var (
+		command = jsonSchema{"type": "string", "description": "Command run with sh -c."}
+		argv    = jsonSchema{"type": "array", "items": jsonSchema{"type": "string"}, "minItems": 1}
+	)
+	return jsonSchema{
+		"oneOf": []jsonSchema{
+			command,
+			argv,
+			{
+				"type": "object",
+				"properties": jsonSchema{
+					"run":     jsonSchema{"oneOf": []jsonSchema{command, argv}},
+					"env":     s.schema(reflect.TypeOf(map[string]string(nil))),
+					"timeout": jsonSchema{"type": "string", "description": "Duration, for example 10m."},
+				},
+				"required":             []string{"run"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+func schemaCommand(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s schema\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	b, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		fmt.Println("error:", err)
+		return 1
+	}
+	os.Stdout.Write(append(b, '\n'))
+	return 0
+}
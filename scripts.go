@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const defaultInterpreter = "/bin/sh"
+
+// Maintainer script phases, named after their Debian counterparts. Scripts
+// for a phase run for every action, with the arguments of the package format.
+var scriptPhases = []string{"preinst", "postinst", "prerm", "postrm"}
+
+// Neutral script hooks run for a single action, the generated scripts check
+// the format specific arguments.
+var scriptHooks = map[string]string{
+	"pre-install":  "preinst",
+	"pre-upgrade":  "preinst",
+	"post-install": "postinst",
+	"post-upgrade": "postinst",
+	"pre-remove":   "prerm",
+	"post-remove":  "postrm",
+}
+
+// Conditions under which a hook runs, per format. Debian passes the action
+// as the first argument, RPM passes the number of installed instances after
+// the transaction.
+var (
+	debScriptConditions = map[string]string{
+		"pre-install":  `[ "$1" = install ]`,
+		"pre-upgrade":  `[ "$1" = upgrade ]`,
+		"post-install": `[ "$1" = configure ] && [ -z "$2" ]`,
+		"post-upgrade": `[ "$1" = configure ] && [ -n "$2" ]`,
+		"pre-remove":   `[ "$1" = remove ]`,
+		"post-remove":  `[ "$1" = remove ]`,
+	}
+	rpmScriptConditions = map[string]string{
+		"pre-install":  `[ "$1" -eq 1 ]`,
+		"pre-upgrade":  `[ "$1" -gt 1 ]`,
+		"post-install": `[ "$1" -eq 1 ]`,
+		"post-upgrade": `[ "$1" -gt 1 ]`,
+		"pre-remove":   `[ "$1" -eq 0 ]`,
+		"post-remove":  `[ "$1" -eq 0 ]`,
+	}
+)
+
+// Scripts maps a phase (preinst, postinst, prerm, postrm) or neutral hook
+// (pre-install, post-upgrade, ...) to a script. Scripts are given inline, or
+// as "file:path" relative to the package path, see Package.readFile.
+type Scripts map[string]string
+
+// load returns a copy of the scripts with file references replaced by their
+// contents.
+func (s Scripts) load(readFile func(string) ([]byte, error)) (Scripts, error) {
+	var loaded = make(Scripts)
+	for name, script := range s {
+		if !isScriptPhase(name) && scriptHooks[name] == "" {
+			return nil, fmt.Errorf("unknown script %q", name)
+		}
+		if strings.HasPrefix(script, "file:") {
+			b, err := readFile(strings.TrimPrefix(script, "file:"))
+			if err != nil {
+				return nil, fmt.Errorf("script %s: %v", name, err)
+			}
+			script = string(b)
+		}
+		loaded[name] = script
+	}
+
+	// Neutral hooks are shell snippets, added to the script of their phase
+	// under a #!/bin/sh line of its own.
+	var hooks = make([]string, 0, len(scriptHooks))
+	for hook := range scriptHooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Strings(hooks)
+	for _, hook := range hooks {
+		if phase := scriptHooks[hook]; loaded[hook] != "" && strings.HasPrefix(loaded[phase], "#!") {
+			return nil, fmt.Errorf("script %s: has its own interpreter %s, it can't be combined with %s",
+				phase, strings.Join(scriptInterpreter(loaded[phase]), " "), hook)
+		}
+	}
+	return loaded, nil
+}
+
+// deb returns the Debian maintainer scripts, keyed by phase.
+func (s Scripts) deb() map[string]string {
+	return s.generate(debScriptConditions)
+}
+
+// rpm returns the RPM scriptlets, keyed by phase.
+func (s Scripts) rpm() map[string]string {
+	return s.generate(rpmScriptConditions)
+}
+
+func (s Scripts) generate(conditions map[string]string) map[string]string {
+	var scripts = make(map[string]string)
+	for _, phase := range scriptPhases {
+		var (
+			buf   = new(bytes.Buffer)
+			hooks []string
+		)
+		for hook, hookPhase := range scriptHooks {
+			if hookPhase == phase && s[hook] != "" {
+				hooks = append(hooks, hook)
+			}
+		}
+		if s[phase] == "" && len(hooks) == 0 {
+			continue
+		}
+		sort.Strings(hooks)
+
+		// A phase script with its own interpreter has no hooks, see load.
+		if strings.HasPrefix(s[phase], "#!") {
+			scripts[phase] = s[phase]
+			continue
+		}
+
+		buf.WriteString("#!" + defaultInterpreter + "\nset -e\n")
+		if script := s[phase]; script != "" {
+			buf.WriteString(strings.TrimSuffix(script, "\n") + "\n")
+		}
+		for _, hook := range hooks {
+			fmt.Fprintf(buf, "\n# %s\nif %s; then\n%s\nfi\n", hook, conditions[hook],
+				strings.TrimSuffix(s[hook], "\n"))
+		}
+		scripts[phase] = buf.String()
+	}
+	return scripts
+}
+
+// scriptInterpreter returns the interpreter named in the #! line of script,
+// followed by its arguments.
+func scriptInterpreter(script string) []string {
+	if !strings.HasPrefix(script, "#!") {
+		return []string{defaultInterpreter}
+	}
+	var line = script[2:]
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	if fields := strings.Fields(line); len(fields) > 0 {
+		return fields
+	}
+	return []string{defaultInterpreter}
+}
+
+func isScriptPhase(name string) bool {
+	for _, phase := range scriptPhases {
+		if name == phase {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScriptInterpreter(t *testing.T) {
+	var tests = []struct {
+		script string
+		want   []string
+	}{
+		{"echo hi\n", []string{"/bin/sh"}},
+		{"#!/bin/sh\necho hi\n", []string{"/bin/sh"}},
+		{"#!/bin/bash -e\necho hi\n", []string{"/bin/bash", "-e"}},
+		{"#! /usr/bin/env python3\nprint(1)\n", []string{"/usr/bin/env", "python3"}},
+		{"#!\n", []string{"/bin/sh"}},
+	}
+	for _, test := range tests {
+		if got := scriptInterpreter(test.script); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("scriptInterpreter(%q) = %q, want %q", test.script, got, test.want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"hash"
 	"io"
 	"os"
@@ -108,21 +109,102 @@ func (t tree) ReadDir(p string) ([]os.FileInfo, error) {
 	return l, nil
 }
 
+// sorted returns the leafs in the tree, ordered by name.
+func (t tree) sorted() leafs {
+	l := make(leafs, 0, len(t))
+	for _, leaf := range t {
+		l = append(l, leaf)
+	}
+	sort.Sort(l)
+	return l
+}
+
 type leaf struct {
 	io.ReadSeeker
-	name string
-	mode os.FileMode
-	data []byte
+	name  string
+	mode  os.FileMode
+	owner string
+	group string
+	uid   int
+	gid   int
+	mtime time.Time
+	link  string
+
+	// Regular files are read from src when the archive is written, the
+	// size is taken when the file is added. Symlinks record their src too.
+	src      string
+	filesize int64
+
+	// config marks configuration files that are preserved on upgrade.
+	config    bool
+	noreplace bool
 }
 
-func (l leaf) Close() error               { return nil }
-func (l leaf) stat() os.FileInfo          { return info{name: l.name, mode: l.mode} }
+func (l leaf) Close() error { return nil }
+func (l leaf) stat() os.FileInfo {
+	return info{name: l.name, mode: l.mode, size: l.size(), dir: l.mode.IsDir()}
+}
 func (l leaf) Stat() (os.FileInfo, error) { return l.stat(), nil }
 
-func (l leaf) Checksum(h hash.Hash) []byte {
+// source describes where the leaf comes from, for errors.
+func (l leaf) source() string {
+	switch {
+	case l.src != "":
+		return l.src
+	case l.mode.IsDir():
+		return "directory"
+	default:
+		return "symlink to " + l.link
+	}
+}
+
+// size returns the size of the leaf in the archive, the length of the link for
+// symlinks.
+func (l leaf) size() int64 {
+	switch {
+	case l.mode&os.ModeSymlink != 0:
+		return int64(len(l.link))
+	case l.mode.IsDir():
+		return 0
+	default:
+		return l.filesize
+	}
+}
+
+// open opens the source of a regular file.
+func (l leaf) open() (io.ReadCloser, error) {
+	return os.Open(l.src)
+}
+
+// copyTo copies the contents of a regular file to w, failing if the size of
+// the source changed since it was added.
+func (l leaf) copyTo(w io.Writer) (int64, error) {
+	f, err := l.open()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := io.CopyN(w, f, l.filesize)
+	if err == io.EOF {
+		err = fmt.Errorf("%s: file changed size while packaging", l.src)
+	}
+	return n, err
+}
+
+// modTime returns the modification time of the leaf, clamped to now.
+func (l leaf) modTime(now time.Time) time.Time {
+	if l.mtime.IsZero() || l.mtime.After(now) {
+		return now
+	}
+	return l.mtime
+}
+
+func (l leaf) Checksum(h hash.Hash) ([]byte, error) {
 	h.Reset()
-	h.Write(l.data)
-	return h.Sum(nil)
+	if _, err := l.copyTo(h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
 }
 
 type info struct {
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// See deb-src-control(5) and the RPM packaging guidelines.
+	debPackageName = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+	rpmPackageName = regexp.MustCompile(`^[A-Za-z0-9_+][A-Za-z0-9_+.-]*$`)
+
+	manifestType     = reflect.TypeOf(Manifest(nil))
+	generateStepType = reflect.TypeOf(GenerateStep{})
+)
+
+// configChecker validates a config, converted to JSON, against the config
+// structures. Unlike json.Unmarshal, it rejects unknown keys and reports all
+// errors, with their position if known.
+type configChecker struct {
+	dec      *json.Decoder
+	position func(path string, offset int64) (line, col int, ok bool)
+	offsets  map[string]int64
+	errs     []error
+}
+
+// checkConfig returns the problems found in the config. A syntax error stops
+// the check.
+func checkConfig(b []byte, position func(string, int64) (int, int, bool)) []error {
+	var c = &configChecker{
+		dec:      json.NewDecoder(bytes.NewReader(b)),
+		position: position,
+		offsets:  make(map[string]int64),
+	}
+	c.dec.UseNumber()
+	if err := c.value("", reflect.TypeOf(Config{})); err != nil {
+		return append(c.errs, err)
+	}
+
+	// Check the values that are valid JSON, but not a valid package. Values of
+	// the wrong type are reported above, and skipped by json.Unmarshal.
+	var config Config
+	if err := json.Unmarshal(b, &config); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return append(c.errs, err)
+		}
+	}
+	var names = make([]string, 0, len(config.Package))
+	for name := range config.Package {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, key := range names {
+		c.checkPackage(key, config.Package[key])
+	}
+	return c.errs
+}
+
+func (c *configChecker) checkPackage(key string, pkg Package) {
+	var (
+		path  = "package." + key
+		name  = pkg.Name
+		where = path + ".name"
+	)
+	if name == "" {
+		name, where = key, path
+	}
+
+	var formats = pkg.Formats
+	if len(formats) == 0 {
+		for format := range supportedFormats {
+			formats = append(formats, format)
+		}
+	}
+	for _, format := range formats {
+		switch format {
+		case "deb":
+			if !debPackageName.MatchString(name) {
+				c.errorAt(where, "invalid deb package name %q, must be lowercase alphanumerics and +.- of at least 2 characters", name)
+			}
+		case "rpm":
+			if !rpmPackageName.MatchString(name) {
+				c.errorAt(where, "invalid rpm package name %q, must be alphanumerics and _+.-", name)
+			}
+		}
+	}
+	for i, format := range pkg.Formats {
+		if !supportedFormats[format] {
+			c.errorAt(fmt.Sprintf("%s.formats[%d]", path, i), "unsupported format %q", format)
+		}
+	}
+}
+
+// errorf records an error at the value of path, starting at offset.
+func (c *configChecker) errorf(path string, offset int64, format string, args ...interface{}) {
+	var err = fmt.Errorf(format, args...)
+	if c.position != nil {
+		if line, col, ok := c.position(path, offset); ok {
+			err = &positionError{line: line, col: col, err: err}
+		}
+	}
+	c.errs = append(c.errs, err)
+}
+
+// errorAt records an error at the value of path.
+func (c *configChecker) errorAt(path, format string, args ...interface{}) {
+	c.errorf(path, c.offsets[path], path+": "+format, args...)
+}
+
+// token reads the next token, and returns the offset just past its first
+// byte.
+func (c *configChecker) token() (json.Token, int64, error) {
+	tok, err := c.dec.Token()
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		end  = c.dec.InputOffset()
+		size int64
+	)
+	switch v := tok.(type) {
+	case json.Delim:
+		size = 1
+	case string:
+		b, _ := json.Marshal(v)
+		size = int64(len(b))
+	case json.Number:
+		size = int64(len(v))
+	case bool:
+		size = 4
+		if !v {
+			size = 5
+		}
+	case nil:
+		size = 4
+	}
+	return tok, end - size + 1, nil
+}
+
+// skip skips the rest of a value starting with tok.
+func (c *configChecker) skip(tok json.Token) error {
+	if tok != json.Delim('{') && tok != json.Delim('[') {
+		return nil
+	}
+	for depth := 1; depth > 0; {
+		tok, err := c.dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return nil
+}
+
+// value checks the next value against type t.
+func (c *configChecker) value(path string, t reflect.Type) error {
+	tok, offset, err := c.token()
+	if err != nil {
+		return err
+	}
+	c.offsets[path] = offset
+	if tok == nil {
+		return nil
+	}
+
+	switch t {
+	case manifestType:
+		return c.manifest(path, tok, offset)
+	case generateStepType:
+		return c.generateStep(path, tok, offset)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if tok != json.Delim('{') {
+			c.errorf(path, offset, "%s: expected an object", path)
+			return c.skip(tok)
+		}
+		return c.object(path, func(key string) (reflect.Type, bool) {
+			return fieldType(t, key)
+		})
+
+	case reflect.Map:
+		if tok != json.Delim('{') {
+			c.errorf(path, offset, "%s: expected an object", path)
+			return c.skip(tok)
+		}
+		return c.object(path, func(string) (reflect.Type, bool) {
+			return t.Elem(), true
+		})
+
+	case reflect.Slice:
+		if tok != json.Delim('[') {
+			c.errorf(path, offset, "%s: expected a list", path)
+			return c.skip(tok)
+		}
+		return c.list(path, t.Elem())
+
+	case reflect.String:
+		if _, ok := tok.(string); !ok {
+			c.errorf(path, offset, "%s: expected a string", path)
+			return c.skip(tok)
+		}
+
+	case reflect.Bool:
+		if _, ok := tok.(bool); !ok {
+			c.errorf(path, offset, "%s: expected true or false", path)
+			return c.skip(tok)
+		}
+
+	case reflect.Int:
+		n, ok := tok.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			c.errorf(path, offset, "%s: expected an integer", path)
+			return c.skip(tok)
+		}
+	}
+	return nil
+}
+
+// object checks the keys and values of an object, after its opening brace.
+func (c *configChecker) object(path string, field func(key string) (reflect.Type, bool)) error {
+	for c.dec.More() {
+		tok, offset, err := c.token()
+		if err != nil {
+			return err
+		}
+		var (
+			key     = tok.(string)
+			keyPath = key
+		)
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		t, ok := field(key)
+		if !ok && path == "" && strings.HasPrefix(key, "x-") {
+			// Extension keys, for example to hold YAML anchors.
+			if tok, _, err = c.token(); err != nil {
+				return err
+			}
+			if err = c.skip(tok); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			c.errorf(keyPath, offset, "unknown key %s", keyPath)
+			if tok, _, err = c.token(); err != nil {
+				return err
+			}
+			if err = c.skip(tok); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = c.value(keyPath, t); err != nil {
+			return err
+		}
+	}
+	_, err := c.dec.Token()
+	return err
+}
+
+// list checks the items of a list, after its opening bracket.
+func (c *configChecker) list(path string, t reflect.Type) error {
+	for i := 0; c.dec.More(); i++ {
+		if err := c.value(fmt.Sprintf("%s[%d]", path, i), t); err != nil {
+			return err
+		}
+	}
+	_, err := c.dec.Token()
+	return err
+}
+
+// manifest checks the object or list form of a manifest.
+func (c *configChecker) manifest(path string, tok json.Token, offset int64) error {
+	switch tok {
+	case json.Delim('['):
+		return c.list(path, reflect.TypeOf(manifestListEntry{}))
+	case json.Delim('{'):
+		for c.dec.More() {
+			tok, _, err := c.token()
+			if err != nil {
+				return err
+			}
+			var keyPath = path + "." + tok.(string)
+			if tok, offset, err = c.token(); err != nil {
+				return err
+			}
+			c.offsets[keyPath] = offset
+			if _, ok := tok.(string); ok {
+				continue
+			}
+			if tok != json.Delim('{') {
+				c.errorf(keyPath, offset, "%s: expected a target or an object", keyPath)
+				if err = c.skip(tok); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = c.object(keyPath, func(key string) (reflect.Type, bool) {
+				return fieldType(reflect.TypeOf(Target{}), key)
+			}); err != nil {
+				return err
+			}
+		}
+		_, err := c.dec.Token()
+		return err
+	default:
+		c.errorf(path, offset, "%s: expected an object or a list", path)
+		return c.skip(tok)
+	}
+}
+
+// generateStep checks a command, an argv list, or an object with run.
+func (c *configChecker) generateStep(path string, tok json.Token, offset int64) error {
+	switch tok {
+	case json.Delim('['):
+		return c.list(path, reflect.TypeOf(""))
+	case json.Delim('{'):
+		var hasRun bool
+		if err := c.object(path, func(key string) (reflect.Type, bool) {
+			switch strings.ToLower(key) {
+			case "run":
+				hasRun = true
+				return generateStepType, true
+			case "env":
+				return reflect.TypeOf(map[string]string(nil)), true
+			case "timeout":
+				return reflect.TypeOf(""), true
+			}
+			return nil, false
+		}); err != nil {
+			return err
+		}
+		if !hasRun {
+			c.errorf(path, offset, "%s: step without run", path)
+		}
+		return nil
+	default:
+		if _, ok := tok.(string); !ok {
+			c.errorf(path, offset, "%s: expected a command, argv list or object", path)
+		}
+		return nil
+	}
+}
+
+// fieldType returns the type of the field decoded from key, matched like
+// encoding/json does.
+func fieldType(t reflect.Type, key string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		var f = t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			if ft, ok := fieldType(f.Type, key); ok {
+				return ft, true
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		var name = f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gogits/git-module"
+)
+
+const defaultRelease = "1"
+
+var (
+	// See deb-version(7), the epoch and revision are separate fields.
+	debUpstreamVersion = regexp.MustCompile(`^[0-9][A-Za-z0-9.+~]*$`)
+	debRevision        = regexp.MustCompile(`^[A-Za-z0-9.+~]+$`)
+
+	// Version and release may not contain a dash, see rpmbuild.
+	rpmVersion = regexp.MustCompile(`^[A-Za-z0-9._+~^]+$`)
+)
+
+// trimVersion strips the "v" from tags like v1.2.3.
+func trimVersion(v string) string {
+	if len(v) > 1 && (v[0] == 'v' || v[0] == 'V') && v[1] >= '0' && v[1] <= '9' {
+		return v[1:]
+	}
+	return v
+}
+
+func (pkg *Package) tagPattern() string {
+	if pkg.TagPattern == "" {
+		return "*"
+	}
+	return pkg.TagPattern
+}
+
+// tagVersion returns the version of a tag, with the literal prefix of the tag
+// pattern stripped, "ship-" for "ship-*".
+func (pkg *Package) tagVersion(tag string) string {
+	var prefix = pkg.tagPattern()
+	if i := strings.IndexAny(prefix, "*?["); i >= 0 {
+		prefix = prefix[:i]
+	}
+	return trimVersion(strings.TrimPrefix(tag, prefix))
+}
+
+// sourceVersion reads the version from a source: "file:path" and "go:path"
+// relative to the package path, the output of "cmd:command" run in the package
+// path, or "env:NAME". Other versions are returned as is. Packages built from a
+// checkout read files at Branch, see readFile, and can't use cmd as it would
+// run in the working tree.
+func (pkg *Package) sourceVersion(source string) (string, error) {
+	i := strings.Index(source, ":")
+	if i < 0 {
+		return source, nil
+	}
+
+	var (
+		kind, arg = source[:i], source[i+1:]
+		v         string
+		err       error
+	)
+	switch kind {
+	case "file":
+		var b []byte
+		if b, err = pkg.readFile(arg); err != nil {
+			return "", fmt.Errorf("version %s: %v", source, err)
+		}
+		v = string(b)
+
+	case "cmd":
+		if pkg.Checkout {
+			return "", fmt.Errorf("version %s: can't run a command in a checkout build", source)
+		}
+		var (
+			cmd    = exec.Command("sh", "-c", arg)
+			stderr = new(bytes.Buffer)
+			out    []byte
+		)
+		cmd.Dir = pkg.Path
+		cmd.Stderr = stderr
+		if out, err = cmd.Output(); err != nil {
+			return "", fmt.Errorf("version %s: %v\n%s", source, err, stderr)
+		}
+		v = string(out)
+
+	case "env":
+		if v = os.Getenv(arg); v == "" {
+			return "", fmt.Errorf("version %s: %s is not set", source, arg)
+		}
+
+	case "go":
+		var b []byte
+		if b, err = pkg.readFile(arg); err != nil {
+			return "", fmt.Errorf("version %s: %v", source, err)
+		}
+		if v, err = goVersion(arg, b); err != nil {
+			return "", fmt.Errorf("version %s: %v", source, err)
+		}
+
+	default:
+		return source, nil
+	}
+
+	if v = strings.TrimSpace(v); v == "" {
+		return "", fmt.Errorf("version %s: empty version", source)
+	}
+	return preRelease(trimVersion(v)), nil
+}
+
+// goVersion returns the value of the string constant Version in a Go file.
+func goVersion(file string, src []byte) (string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), file, src, 0)
+	if err != nil {
+		return "", err
+	}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			for i, name := range value.Names {
+				if name.Name != "Version" || i >= len(value.Values) {
+					continue
+				}
+				lit, ok := value.Values[i].(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					return "", fmt.Errorf("%s: Version is not a string literal", file)
+				}
+				return strconv.Unquote(lit.Value)
+			}
+		}
+	}
+	return "", fmt.Errorf("%s: no const Version", file)
+}
+
+// readFile reads name relative to the package path. Packages built from a
+// checkout read name from Repo at Branch instead, relative to the location of
+// the package path in the repository, so uncommitted changes are never used.
+func (pkg *Package) readFile(name string) ([]byte, error) {
+	if !pkg.Checkout {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(pkg.Path, name)
+		}
+		return ioutil.ReadFile(name)
+	}
+	if filepath.IsAbs(name) {
+		return nil, fmt.Errorf("%s: absolute path in a checkout build", name)
+	}
+	out, err := git.NewCommand("show", pkg.Branch+":"+path.Join(pkg.subdir, filepath.ToSlash(name))).RunInDir(pkg.Repo)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s of %s at %s: %v", name, pkg.Branch, pkg.Repo, err)
+	}
+	return []byte(out), nil
+}
+
+// preRelease turns pre-releases like 1.0.0-rc1 into 1.0.0~rc1, which sorts
+// before 1.0.0 in dpkg and rpm.
+func preRelease(v string) string {
+	return strings.Replace(v, "-", "~", 1)
+}
+
+// verifyVersion checks the version, release and epoch of the package against
+// the version grammar of its formats.
+func (pkg *Package) verifyVersion() error {
+	if pkg.Epoch < 0 {
+		return fmt.Errorf("invalid epoch %d", pkg.Epoch)
+	}
+	if pkg.Release == "" {
+		pkg.Release = defaultRelease
+	}
+	for _, format := range pkg.Formats {
+		switch format {
+		case "deb":
+			if !debUpstreamVersion.MatchString(pkg.Version) {
+				return fmt.Errorf("deb: invalid version %q, must start with a digit and contain only alphanumerics and .+~", pkg.Version)
+			}
+			if !debRevision.MatchString(pkg.Release) {
+				return fmt.Errorf("deb: invalid release %q, may contain only alphanumerics and .+~", pkg.Release)
+			}
+		case "rpm":
+			if !rpmVersion.MatchString(pkg.Version) {
+				return fmt.Errorf("rpm: invalid version %q, may contain only alphanumerics and ._+~^", pkg.Version)
+			}
+			if release := pkg.Release + pkg.RPMDist; !rpmVersion.MatchString(release) {
+				return fmt.Errorf("rpm: invalid release %q, may contain only alphanumerics and ._+~^", release)
+			}
+		}
+	}
+	return nil
+}
+
+// debVersion returns the full Debian version, [epoch:]version-revision.
+func debVersion(epoch int, version, revision string) string {
+	var v = version
+	if revision != "" {
+		v += "-" + revision
+	}
+	if epoch > 0 {
+		v = fmt.Sprintf("%d:%s", epoch, v)
+	}
+	return v
+}
+
+// rpmEVR returns the epoch, version and release as used in dependencies.
+func rpmEVR(epoch int, version, release string) string {
+	var v = version + "-" + release
+	if epoch > 0 {
+		v = fmt.Sprintf("%d:%s", epoch, v)
+	}
+	return v
+}